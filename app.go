@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -16,10 +18,13 @@ type App struct {
 	statusMu     sync.RWMutex
 	logs         []string
 	logsMu       sync.RWMutex
+	traffic      *TrafficStats
+	origins      *clientOrigins
 	proxy        *ProxyServer
 	tunnel       *SSHTunnel
 	tunnelCtx    context.Context
 	tunnelStop   context.CancelFunc
+	draining     map[*ProxyServer]*SSHTunnel // stopped, waiting for open connections
 	mu           sync.Mutex
 }
 
@@ -30,6 +35,14 @@ type Status struct {
 	TunnelRunning   bool   `json:"tunnel_running"`
 	LastError       string `json:"last_error,omitempty"`
 	StartTime       string `json:"start_time,omitempty"`
+
+	// A stopped proxy is still letting open connections finish
+	Draining            bool `json:"draining"`
+	DrainingConnections int  `json:"draining_connections"`
+
+	// Preferred upstream and health of the record's failover list
+	Upstream  string           `json:"upstream,omitempty"`
+	Upstreams []UpstreamStatus `json:"upstreams,omitempty"`
 }
 
 type RecordsResponse struct {
@@ -40,8 +53,11 @@ type RecordsResponse struct {
 // NewApp creates a new App instance
 func NewApp() *App {
 	return &App{
-		status: &Status{},
-		logs:   make([]string, 0, 100),
+		status:   &Status{},
+		logs:     make([]string, 0, 100),
+		traffic:  NewTrafficStats(),
+		origins:  newClientOrigins(),
+		draining: make(map[*ProxyServer]*SSHTunnel),
 	}
 }
 
@@ -61,7 +77,10 @@ func (a *App) startup(ctx context.Context) {
 
 // shutdown is called when the app is closing
 func (a *App) shutdown(ctx context.Context) {
-	a.Stop()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.drainLocked()
+	a.forceDrainedLocked()
 }
 
 // GetConfig returns the current configuration (without sensitive data)
@@ -200,10 +219,26 @@ func (a *App) SetActiveRecord(id string) (*Config, error) {
 
 // GetStatus returns the current status
 func (a *App) GetStatus() *Status {
+	a.mu.Lock()
+	draining, connections := len(a.draining) > 0, 0
+	for proxy := range a.draining {
+		connections += proxy.activeConnections()
+	}
+	var upstream string
+	var upstreams []UpstreamStatus
+	if a.proxy != nil {
+		upstream, upstreams = a.proxy.UpstreamStatus()
+	}
+	a.mu.Unlock()
+
 	a.statusMu.RLock()
 	defer a.statusMu.RUnlock()
 
 	status := *a.status
+	status.Draining = draining
+	status.DrainingConnections = connections
+	status.Upstream = upstream
+	status.Upstreams = upstreams
 	return &status
 }
 
@@ -217,21 +252,72 @@ func (a *App) GetLogs() []string {
 	return logs
 }
 
-// Start starts the proxy and SSH tunnel
-func (a *App) Start(config *Config) error {
+// GetTrafficStats returns the live traffic counters and the busiest hosts
+func (a *App) GetTrafficStats() *TrafficSnapshot {
+	return a.traffic.Snapshot()
+}
+
+// GetConnections lists the connections the proxy is currently serving,
+// including those of a stopped proxy that is still draining
+func (a *App) GetConnections() []ConnectionInfo {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	conns := []ConnectionInfo{}
+	for _, proxy := range a.proxiesLocked() {
+		conns = append(conns, proxy.Connections()...)
+	}
+	return conns
+}
+
+// ListNetworkInterfaces lists the interfaces and addresses outbound
+// connections can be bound to
+func (a *App) ListNetworkInterfaces() ([]NetworkInterface, error) {
+	return listNetworkInterfaces()
+}
 
-	// Stop existing tunnel if running
-	if a.tunnelStop != nil {
-		a.tunnelStop()
+// CloseConnection force-closes one proxy connection
+func (a *App) CloseConnection(id uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, proxy := range a.proxiesLocked() {
+		if proxy.CloseConnection(id) {
+			return nil
+		}
 	}
-	if a.tunnel != nil {
-		a.tunnel.Stop()
+	return fmt.Errorf("connection %d not found", id)
+}
+
+// CloseAllConnections force-closes every proxy connection
+func (a *App) CloseAllConnections() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for _, proxy := range a.proxiesLocked() {
+		n += proxy.CloseAllConnections()
 	}
+	a.addLog(fmt.Sprintf("已关闭 %d 个连接", n))
+	return n
+}
+
+// proxiesLocked returns the running proxy and the draining ones
+func (a *App) proxiesLocked() []*ProxyServer {
+	var proxies []*ProxyServer
 	if a.proxy != nil {
-		a.proxy.Stop()
+		proxies = append(proxies, a.proxy)
+	}
+	for proxy := range a.draining {
+		proxies = append(proxies, proxy)
 	}
+	return proxies
+}
+
+// Start starts the proxy and SSH tunnel
+func (a *App) Start(config *Config) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Let the connections of the previous run finish in the background
+	a.drainLocked()
 
 	if config.SSHPort == 0 {
 		config.SSHPort = 22
@@ -257,16 +343,18 @@ func (a *App) Start(config *Config) error {
 	a.addLog("正在启动代理服务器...")
 
 	// Start proxy server
-	a.proxy = NewProxyServer(config.ProxyPort, config.HTTPProxy, config.HTTPSProxy, func(level, msg string) {
+	a.proxy = NewProxyServer(config, a.traffic, func(level, msg string) {
 		a.log(level, msg)
 	})
+	a.proxy.origins = a.origins
+	proxy := a.proxy
 	go func() {
 		if config.HTTPProxy != "" || config.HTTPSProxy != "" {
 			a.addLog(fmt.Sprintf("上游代理: HTTP=%s HTTPS=%s", config.HTTPProxy, config.HTTPSProxy))
 		}
 		a.addLog(fmt.Sprintf("代理服务监听 127.0.0.1:%d", config.ProxyPort))
 		a.updateStatus(true, false, true, "")
-		if err := a.proxy.Start(); err != nil {
+		if err := proxy.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			a.addLog(fmt.Sprintf("代理服务错误: %v", err))
 			a.updateStatus(false, false, false, err.Error())
 		}
@@ -276,6 +364,7 @@ func (a *App) Start(config *Config) error {
 	a.tunnel = NewSSHTunnel(config, func(level, msg string) {
 		a.log(level, msg)
 	})
+	a.tunnel.origins = a.origins
 	a.tunnel.OnStatusChange = func(connected bool, err error) {
 		errMsg := ""
 		if err != nil {
@@ -288,10 +377,11 @@ func (a *App) Start(config *Config) error {
 		a.updateStatus(true, connected, true, errMsg)
 	}
 
+	tunnel, tunnelCtx := a.tunnel, a.tunnelCtx
 	go func() {
 		a.addLog(fmt.Sprintf("正在连接 %s@%s:%d...", config.SSHUser, config.SSHHost, config.SSHPort))
 
-		if err := a.tunnel.Start(a.tunnelCtx); err != nil {
+		if err := tunnel.Start(tunnelCtx); err != nil {
 			a.addLog(fmt.Sprintf("SSH 隧道错误: %v", err))
 			a.updateStatus(true, false, false, err.Error())
 		}
@@ -300,28 +390,70 @@ func (a *App) Start(config *Config) error {
 	return nil
 }
 
-// Stop stops the proxy and SSH tunnel
+// Stop stops the proxy and SSH tunnel. Open connections may finish until
+// the record's drain timeout; calling Stop again while they drain closes
+// them at once.
 func (a *App) Stop() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if a.tunnelStop != nil {
-		a.tunnelStop()
-		a.tunnelStop = nil
+	if a.proxy == nil && a.tunnel == nil && len(a.draining) > 0 {
+		a.forceDrainedLocked()
+		a.addLog("已强制关闭剩余连接")
+		return
 	}
 
-	if a.tunnel != nil {
-		a.tunnel.Stop()
-		a.tunnel = nil
+	a.drainLocked()
+	a.updateStatus(false, false, false, "")
+	a.addLog("隧道已停止")
+}
+
+// drainLocked stops the running proxy and tunnel from accepting connections
+// and lets the open ones finish in the background
+func (a *App) drainLocked() {
+	proxy, tunnel, stop := a.proxy, a.tunnel, a.tunnelStop
+	a.proxy, a.tunnel, a.tunnelStop = nil, nil, nil
+	if proxy == nil || tunnel == nil {
+		if proxy != nil {
+			proxy.Stop()
+		}
+		if tunnel != nil {
+			tunnel.Stop()
+		}
+		if stop != nil {
+			stop()
+		}
+		return
 	}
 
-	if a.proxy != nil {
-		a.proxy.Stop()
-		a.proxy = nil
+	timeout := drainTimeout(proxy.settings)
+	tunnelDone := tunnel.Drain(timeout)
+	proxyDone := proxy.Drain(timeout)
+	a.draining[proxy] = tunnel
+	if n := proxy.activeConnections(); n > 0 {
+		a.addLog(fmt.Sprintf("正在等待 %d 个连接结束 (最长 %s)...", n, timeout))
 	}
 
-	a.updateStatus(false, false, false, "")
-	a.addLog("隧道已停止")
+	go func() {
+		<-tunnelDone
+		<-proxyDone
+		if stop != nil {
+			stop()
+		}
+
+		a.mu.Lock()
+		delete(a.draining, proxy)
+		a.mu.Unlock()
+		a.log(LevelDebug, "Drain finished")
+	}()
+}
+
+// forceDrainedLocked closes the connections that are still draining
+func (a *App) forceDrainedLocked() {
+	for proxy, tunnel := range a.draining {
+		proxy.Stop()
+		tunnel.Stop()
+	}
 }
 
 // updateStatus updates the connection status
@@ -430,6 +562,8 @@ func (a *App) upsertRecordFromConfigLocked(config *Config) {
 		HTTPProxy:  config.HTTPProxy,
 		HTTPSProxy: config.HTTPSProxy,
 		LogLevel:   config.LogLevel,
+
+		ProxySettings: config.ProxySettings,
 	}
 	if record.Name == "" {
 		if idx := a.config.findRecordIndex(record.ID); idx >= 0 {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -22,6 +23,112 @@ type RemoteRecord struct {
 	HTTPProxy  string `json:"http_proxy,omitempty"`
 	HTTPSProxy string `json:"https_proxy,omitempty"`
 	LogLevel   string `json:"log_level,omitempty"` // DEBUG, INFO, ERROR
+
+	ProxySettings
+}
+
+// ProxySettings holds the per-record options of the local proxy server.
+// It is embedded in both RemoteRecord and Config, so the JSON stays flat.
+type ProxySettings struct {
+	// ProxyUsers lists "user:password" pairs; when set, HTTP, CONNECT and SOCKS5 clients must authenticate
+	ProxyUsers []string `json:"proxy_users,omitempty"`
+
+	// TLS options for https:// upstream proxies
+	UpstreamCAFile     string `json:"upstream_ca_file,omitempty"`     // extra CA bundle (PEM)
+	UpstreamCertFile   string `json:"upstream_cert_file,omitempty"`   // client certificate (PEM)
+	UpstreamKeyFile    string `json:"upstream_key_file,omitempty"`    // client private key (PEM)
+	UpstreamServerName string `json:"upstream_server_name,omitempty"` // SNI override
+
+	// Ordered failover list of upstream proxies ("DIRECT" for none) used
+	// instead of HTTPProxy / HTTPSProxy. Each is health-checked by a CONNECT
+	// to HealthCheckTarget every HealthCheckInterval seconds; requests go to
+	// the first healthy one, or the fastest with UpstreamSelection "latency".
+	UpstreamProxies     []string `json:"upstream_proxies,omitempty"`
+	UpstreamSelection   string   `json:"upstream_selection,omitempty"`
+	HealthCheckTarget   string   `json:"health_check_target,omitempty"`
+	HealthCheckInterval int      `json:"health_check_interval,omitempty"`
+
+	// Choose upstreams from A's HTTP_PROXY / HTTPS_PROXY / NO_PROXY
+	// environment variables instead of HTTPProxy / HTTPSProxy
+	UseEnvironmentProxy bool `json:"use_environment_proxy,omitempty"`
+
+	// Also serve origin-form requests below ReversePrefix (default
+	// "/anthropic") by forwarding them to the Anthropic API, so B can set
+	// ANTHROPIC_BASE_URL instead of HTTPS_PROXY
+	ReverseProxy  bool   `json:"reverse_proxy,omitempty"`
+	ReversePrefix string `json:"reverse_prefix,omitempty"`
+
+	// Proxy auto-config script (URL or file path) choosing the upstream per host
+	PACURL string `json:"pac_url,omitempty"`
+
+	// Destination policy: "allow|deny host[:ports]" lines, first match wins,
+	// followed by the rules of the named preset (e.g. "claude-code")
+	PolicyRules  []string `json:"policy_rules,omitempty"`
+	PolicyPreset string   `json:"policy_preset,omitempty"`
+
+	// Routing rules: "host[:ports] direct|upstream|block|proxy URL" lines,
+	// first match wins; unmatched destinations use the upstream settings
+	RouteRules []string `json:"route_rules,omitempty"`
+
+	// Loopback, link-local and private destinations are blocked; these
+	// CIDRs re-enable specific ranges
+	AllowPrivateNetworks []string `json:"allow_private_networks,omitempty"`
+
+	// DNS server for direct connections: empty for the system resolver,
+	// "1.1.1.1", "tcp://1.1.1.1:53" or a DNS-over-HTTPS URL; DNSHosts are
+	// static overrides in hosts file format ("address name [name...]")
+	DNSServer string   `json:"dns_server,omitempty"`
+	DNSHosts  []string `json:"dns_hosts,omitempty"`
+
+	// Outbound connections leave from this source address and/or network
+	// interface (interface names are Linux only) instead of the default route
+	EgressAddress   string `json:"egress_address,omitempty"`
+	EgressInterface string `json:"egress_interface,omitempty"`
+
+	// Connection pool for plain-HTTP egress (0 = default)
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     int `json:"idle_conn_timeout,omitempty"` // seconds
+
+	// Timeouts in seconds (0 = default), and per-host overrides such as
+	// "*.anthropic.com idle=600 lifetime=0". Defaults: dial 30, TLS 10,
+	// response headers 300, plain-HTTP stream idle 300; tunnel idle and
+	// lifetime are unlimited.
+	DialTimeout           int      `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   int      `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout int      `json:"response_header_timeout,omitempty"`
+	StreamIdleTimeout     int      `json:"stream_idle_timeout,omitempty"`
+	TunnelIdleTimeout     int      `json:"tunnel_idle_timeout,omitempty"`
+	MaxConnLifetime       int      `json:"max_conn_lifetime,omitempty"`
+	TimeoutRules          []string `json:"timeout_rules,omitempty"`
+
+	// Seconds open connections may take to finish when the tunnel is
+	// stopped or restarted before they are closed
+	DrainTimeout int `json:"drain_timeout,omitempty"`
+
+	// Limits, zero means unlimited. Concurrency is counted in total and per
+	// destination host; request rates (per second) and bandwidth (KB/s)
+	// apply to the record and to each authenticated client. An exchange
+	// over a limit waits up to LimitWait seconds before it is rejected.
+	MaxConnections          int `json:"max_connections,omitempty"`
+	MaxConnectionsPerHost   int `json:"max_connections_per_host,omitempty"`
+	RequestsPerSecond       int `json:"requests_per_second,omitempty"`
+	ClientRequestsPerSecond int `json:"client_requests_per_second,omitempty"`
+	RequestBurst            int `json:"request_burst,omitempty"`
+	BandwidthLimit          int `json:"bandwidth_limit,omitempty"`
+	ClientBandwidthLimit    int `json:"client_bandwidth_limit,omitempty"`
+	LimitWait               int `json:"limit_wait,omitempty"`
+
+	// Destinations (host globs, default *.anthropic.com) whose traffic is
+	// relayed ahead of bulk flows within TunnelBandwidth (KB/s, per
+	// direction; zero disables scheduling)
+	PriorityHosts   []string `json:"priority_hosts,omitempty"`
+	TunnelBandwidth int      `json:"tunnel_bandwidth,omitempty"`
+
+	// Forwarding headers: Via (also used for loop detection) and
+	// X-Forwarded-For / Forwarded with the client address
+	AddViaHeader    bool `json:"add_via_header,omitempty"`
+	AddForwardedFor bool `json:"add_forwarded_for,omitempty"`
 }
 
 type Config struct {
@@ -45,7 +152,10 @@ type Config struct {
 	// Upstream proxy settings (for A computer to access internet)
 	HTTPProxy  string `json:"http_proxy,omitempty"`
 	HTTPSProxy string `json:"https_proxy,omitempty"`
-	
+
+	// Local proxy server settings
+	ProxySettings
+
 	// App settings
 	LogLevel string `json:"log_level"` // DEBUG, INFO, ERROR
 }
@@ -158,6 +268,8 @@ func (c *Config) normalize() {
 			RemotePort: c.RemotePort,
 			HTTPProxy:  c.HTTPProxy,
 			HTTPSProxy: c.HTTPSProxy,
+
+			ProxySettings: c.ProxySettings,
 		}
 		c.applyDefaultsToRecord(&record)
 		c.Records = []RemoteRecord{record}
@@ -225,8 +337,29 @@ func (c *Config) syncLegacyFromActive() {
 	c.RemotePort = record.RemotePort
 	c.HTTPProxy = record.HTTPProxy
 	c.HTTPSProxy = record.HTTPSProxy
+	c.ProxySettings = record.ProxySettings
 	c.LogLevel = record.LogLevel
 	if c.LogLevel == "" {
 		c.LogLevel = "INFO"
 	}
 }
+
+// recordLabel names the record in traffic statistics, like the record list
+// in the UI does
+func (c *Config) recordLabel() string {
+	if name := strings.TrimSpace(c.RecordName); name != "" {
+		return name
+	}
+	var label string
+	switch {
+	case c.SSHUser != "" && c.SSHHost != "":
+		label = c.SSHUser + "@" + c.SSHHost
+	case c.SSHHost != "":
+		label = c.SSHHost
+	case c.SSHUser != "":
+		label = c.SSHUser
+	default:
+		return "未命名记录"
+	}
+	return fmt.Sprintf("%s:%d", label, c.SSHPort)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Connection states shown in the connection table
+const (
+	connConnecting = "connecting" // checking policy, dialing or waiting for response headers
+	connOpen       = "open"       // tunnel relaying or response streaming
+	connClosing    = "closing"    // force-closed, waiting for the handler to return
+)
+
+// errConnectionKilled is the cause of requests force-closed from the connection table
+var errConnectionKilled = errors.New("connection closed by user")
+
+// ConnectionInfo describes one active proxy connection for the frontend
+type ConnectionInfo struct {
+	ID         uint64 `json:"id"`
+	Kind       string `json:"kind"`   // CONNECT, SOCKS5, HTTP or API (reverse proxy)
+	Client     string `json:"client"` // client address on B for tunnelled connections
+	Tunneled   bool   `json:"tunneled"`
+	User       string `json:"user,omitempty"`
+	Target     string `json:"target"`
+	Priority   bool   `json:"priority"`
+	State      string `json:"state"`
+	StartTime  string `json:"start_time"`
+	DurationMs int64  `json:"duration_ms"`
+	BytesUp    int64  `json:"bytes_up"`
+	BytesDown  int64  `json:"bytes_down"`
+}
+
+// clientOrigins maps the local address of each connection the SSH tunnel
+// opens to the proxy onto the client address B's sshd reported for it in the
+// forwarded-tcpip request
+type clientOrigins struct {
+	m sync.Map // local "ip:port" -> origin "ip:port"
+}
+
+func newClientOrigins() *clientOrigins {
+	return &clientOrigins{}
+}
+
+func (o *clientOrigins) add(local, origin string) {
+	if o != nil {
+		o.m.Store(local, origin)
+	}
+}
+
+func (o *clientOrigins) remove(local string) {
+	if o != nil {
+		o.m.Delete(local)
+	}
+}
+
+// lookup returns the origin of a proxy client address, if it came through the tunnel
+func (o *clientOrigins) lookup(remote string) (string, bool) {
+	if o == nil {
+		return "", false
+	}
+	origin, ok := o.m.Load(remote)
+	if !ok {
+		return "", false
+	}
+	return origin.(string), true
+}
+
+// connRegistry tracks the exchanges a ProxyServer is currently serving, so
+// they can be listed and force-closed. Hijacked tunnels and SOCKS5
+// connections are invisible to http.Server, so Stop closes them from here.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[uint64]*trafficExchange
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*trafficExchange)}
+}
+
+// beginExchange registers a new exchange from client (the proxy client
+// address) to target. The caller must call finishExchange when it is over.
+func (p *ProxyServer) beginExchange(kind, target, client, user string) *trafficExchange {
+	ex := p.traffic.begin(target, p.record)
+	ex.kind = kind
+	ex.target = target
+	ex.user = user
+	ex.state = connConnecting
+	ex.scheduler = p.scheduler
+	ex.priority = p.scheduler.isPriority(ex.host)
+	if origin, ok := p.origins.lookup(client); ok {
+		ex.client, ex.tunneled = origin, true
+	} else {
+		ex.client = client
+	}
+
+	p.conns.mu.Lock()
+	p.conns.conns[ex.id] = ex
+	p.conns.mu.Unlock()
+	return ex
+}
+
+// finishExchange removes an exchange from the registry and the live traffic
+func (p *ProxyServer) finishExchange(ex *trafficExchange) {
+	p.conns.mu.Lock()
+	delete(p.conns.conns, ex.id)
+	p.conns.mu.Unlock()
+	p.traffic.finish(ex)
+}
+
+// activeConnections returns the number of exchanges in progress
+func (p *ProxyServer) activeConnections() int {
+	p.conns.mu.Lock()
+	defer p.conns.mu.Unlock()
+	return len(p.conns.conns)
+}
+
+// Connections lists the active exchanges, oldest first
+func (p *ProxyServer) Connections() []ConnectionInfo {
+	p.conns.mu.Lock()
+	list := make([]*trafficExchange, 0, len(p.conns.conns))
+	for _, ex := range p.conns.conns {
+		list = append(list, ex)
+	}
+	p.conns.mu.Unlock()
+
+	infos := make([]ConnectionInfo, 0, len(list))
+	for _, ex := range list {
+		infos = append(infos, ex.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseConnection force-closes one active exchange, reporting whether it
+// belonged to this proxy
+func (p *ProxyServer) CloseConnection(id uint64) bool {
+	p.conns.mu.Lock()
+	ex, ok := p.conns.conns[id]
+	p.conns.mu.Unlock()
+	if !ok {
+		return false
+	}
+	p.log(LevelInfo, fmt.Sprintf("Closing %s %s from %s", ex.kind, ex.target, ex.client))
+	ex.kill()
+	return true
+}
+
+// CloseAllConnections force-closes every active exchange and returns how
+// many there were
+func (p *ProxyServer) CloseAllConnections() int {
+	p.conns.mu.Lock()
+	list := make([]*trafficExchange, 0, len(p.conns.conns))
+	for _, ex := range p.conns.conns {
+		list = append(list, ex)
+	}
+	p.conns.mu.Unlock()
+
+	for _, ex := range list {
+		ex.kill()
+	}
+	return len(list)
+}
+
+// setCloser sets how the exchange is force-closed and moves it to state.
+// An exchange killed before it had a closer is closed right away.
+func (ex *trafficExchange) setCloser(state string, closer func()) {
+	ex.mu.Lock()
+	killed := ex.killed
+	if !killed {
+		ex.state = state
+		ex.closer = closer
+	}
+	ex.mu.Unlock()
+	if killed {
+		closer()
+	}
+}
+
+// setState moves an exchange that has not been killed to state
+func (ex *trafficExchange) setState(state string) {
+	ex.mu.Lock()
+	if !ex.killed {
+		ex.state = state
+	}
+	ex.mu.Unlock()
+}
+
+// kill closes the exchange's connections; the handler then finishes it
+func (ex *trafficExchange) kill() {
+	ex.mu.Lock()
+	if ex.killed {
+		ex.mu.Unlock()
+		return
+	}
+	ex.killed = true
+	ex.state = connClosing
+	closer := ex.closer
+	close(ex.done)
+	ex.mu.Unlock()
+	if closer != nil {
+		closer()
+	}
+}
+
+func (ex *trafficExchange) info() ConnectionInfo {
+	ex.mu.Lock()
+	state := ex.state
+	ex.mu.Unlock()
+	return ConnectionInfo{
+		ID:         ex.id,
+		Kind:       ex.kind,
+		Client:     ex.client,
+		Tunneled:   ex.tunneled,
+		User:       ex.user,
+		Target:     ex.target,
+		Priority:   ex.priority,
+		State:      state,
+		StartTime:  ex.start.Format(time.RFC3339),
+		DurationMs: time.Since(ex.start).Milliseconds(),
+		BytesUp:    ex.up.Load(),
+		BytesDown:  ex.down.Load(),
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// dialAttemptDelay staggers the connection attempts to a host's
+	// addresses (RFC 8305 Connection Attempt Delay)
+	dialAttemptDelay = 250 * time.Millisecond
+	// maxDialRounds bounds how often a host whose addresses all failed is
+	// dialed again
+	maxDialRounds = 3
+	// dialRetryBackoff is the pause before the second round, doubled after that
+	dialRetryBackoff = 200 * time.Millisecond
+)
+
+// dialAddrs connects to port on one of addrs, racing the addresses Happy
+// Eyeballs style. Rounds in which every address failed quickly (refused,
+// reset, unreachable) are retried; the whole dial is bounded by the
+// destination's dial timeout.
+func (p *ProxyServer) dialAddrs(ctx context.Context, target string, addrs []netip.Addr, port string) (net.Conn, error) {
+	if timeout := p.timeouts.forTarget(target).dial; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := p.egress.reachable(addrs)
+	if err != nil {
+		return nil, err
+	}
+	dialer := p.egress.apply(p.guard.dialer(target), "tcp")
+	addrs = interleaveAddrs(addrs)
+
+	attempts := 0
+	backoff := dialRetryBackoff
+	for round := 1; ; round++ {
+		conn, addr, started, err := raceDial(ctx, dialer, addrs, port)
+		attempts += started
+		if err == nil {
+			p.log(LevelDebug, fmt.Sprintf("Connected to %s via %s (%d attempt(s))", target, addr, attempts))
+			return conn, nil
+		}
+		if round == maxDialRounds || !retryableDialError(err) || ctx.Err() != nil {
+			p.log(LevelDebug, fmt.Sprintf("Dial %s failed after %d attempt(s): %v", target, attempts, err))
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// interleaveAddrs alternates address families, IPv6 first, keeping the
+// resolver's order within each family (RFC 8305 section 4)
+func interleaveAddrs(addrs []netip.Addr) []netip.Addr {
+	var v6, v4 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	sorted := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+// raceDial starts a connection attempt to the next address every
+// dialAttemptDelay, or as soon as the previous attempt fails, and returns
+// the first connection established. It also returns how many attempts were
+// started. When every attempt fails the first error is returned.
+func raceDial(ctx context.Context, dialer *net.Dialer, addrs []netip.Addr, port string) (net.Conn, netip.Addr, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		addr netip.Addr
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	started, pending := 0, 0
+	var delay <-chan time.Time
+	startNext := func() {
+		if started == len(addrs) {
+			delay = nil
+			return
+		}
+		addr := addrs[started]
+		started++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+			results <- result{conn, addr, err}
+		}()
+		delay = time.After(dialAttemptDelay)
+	}
+
+	startNext()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close connections of attempts that succeed after the winner
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.addr, started, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			startNext()
+		case <-delay:
+			startNext()
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, netip.Addr{}, started, firstErr
+}
+
+// retryableDialError reports whether a failed round is worth another try.
+// Refusals by the private-network guard and cancelled or timed-out dials
+// are final.
+func retryableDialError(err error) bool {
+	if errors.Is(err, errPrivateNetwork) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return !(errors.As(err, &netErr) && netErr.Timeout())
+}
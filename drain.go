@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultDrainTimeout bounds how long open connections may take to
+	// finish when the tunnel is stopped or restarted
+	defaultDrainTimeout = 30 * time.Second
+	// drainPollInterval is how often draining checks for remaining connections
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// drainTimeout returns the record's drain timeout
+func drainTimeout(settings ProxySettings) time.Duration {
+	if settings.DrainTimeout > 0 {
+		return time.Duration(settings.DrainTimeout) * time.Second
+	}
+	return defaultDrainTimeout
+}
+
+// waitDrained polls count until it reaches zero or ctx is done, reporting
+// whether everything finished in time
+func waitDrained(ctx context.Context, count func() int) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for count() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// Drain stops accepting connections right away and stops the proxy once the
+// exchanges in progress are over or timeout has passed. The returned channel
+// is closed when the proxy is stopped.
+func (p *ProxyServer) Drain(timeout time.Duration) <-chan struct{} {
+	p.mu.Lock()
+	listener, server := p.listener, p.server
+	p.mu.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// Shutdown closes idle keep-alive connections and waits for the
+		// rest; hijacked tunnels and SOCKS5 connections are in the registry
+		if server != nil {
+			server.Shutdown(ctx)
+		}
+		if !waitDrained(ctx, p.activeConnections) {
+			p.log(LevelInfo, fmt.Sprintf("Drain timeout reached, closing %d connection(s)", p.activeConnections()))
+		}
+		p.Stop()
+	}()
+	return done
+}
+
+// Drain closes the listener on B right away, so no new connections come in,
+// and stops the tunnel once the forwarded connections are over or timeout
+// has passed. The returned channel is closed when the tunnel is stopped.
+func (t *SSHTunnel) Drain(timeout time.Duration) <-chan struct{} {
+	t.mu.Lock()
+	t.reconnect = false
+	t.draining = true
+	listener := t.listener
+	t.mu.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		count := func() int { return int(t.active.Load()) }
+		if !waitDrained(ctx, count) {
+			t.log(LevelInfo, fmt.Sprintf("Drain timeout reached, closing %d tunnel connection(s)", count()))
+		}
+		t.Stop()
+	}()
+	return done
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// errEgressFamily is returned when no destination address matches the
+// family of the egress source address
+var errEgressFamily = errors.New("no destination address matches the egress source address family")
+
+// NetworkInterface is a candidate egress interface for the frontend
+type NetworkInterface struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Up        bool     `json:"up"`
+}
+
+// egressBinding pins the proxy's outbound connections to a source address
+// and/or a network interface, for machines where the default route picks
+// the wrong NIC
+type egressBinding struct {
+	addr  netip.Addr // source address, if set
+	iface string     // interface name, if set (Linux only)
+}
+
+// newEgressBinding checks the record's egress settings; it returns nil when
+// outbound connections follow the default route
+func newEgressBinding(settings ProxySettings) (*egressBinding, error) {
+	source := strings.TrimSpace(settings.EgressAddress)
+	iface := strings.TrimSpace(settings.EgressInterface)
+	if source == "" && iface == "" {
+		return nil, nil
+	}
+
+	e := &egressBinding{iface: iface}
+	if source != "" {
+		addr, err := netip.ParseAddr(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress address %q: %w", source, err)
+		}
+		e.addr = addr.Unmap()
+		if !localAddress(e.addr) {
+			return nil, fmt.Errorf("egress address %s is not assigned to any interface", e.addr)
+		}
+	}
+	if iface != "" {
+		if !bindToDeviceSupported {
+			return nil, fmt.Errorf("binding to interface %s is only supported on Linux, use its address instead", iface)
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("egress interface %s: %w", iface, err)
+		}
+	}
+	return e, nil
+}
+
+// localAddress reports whether addr belongs to one of this machine's interfaces
+func localAddress(addr netip.Addr) bool {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipNet, ok := ifaceAddr.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String describes the binding for logs
+func (e *egressBinding) String() string {
+	var parts []string
+	if e.iface != "" {
+		parts = append(parts, "interface "+e.iface)
+	}
+	if e.addr.IsValid() {
+		parts = append(parts, "source "+e.addr.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// apply binds a dialer for network ("tcp" or "udp") to the egress. A nil
+// binding leaves the dialer unchanged.
+func (e *egressBinding) apply(d *net.Dialer, network string) *net.Dialer {
+	if e == nil {
+		return d
+	}
+	if e.addr.IsValid() {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: e.addr.AsSlice()}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: e.addr.AsSlice()}
+		}
+	}
+	if e.iface != "" {
+		control := d.Control
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return bindToDevice(c, e.iface)
+		}
+	}
+	return d
+}
+
+// reachable drops destination addresses the source address cannot reach
+// because they are of the other IP family
+func (e *egressBinding) reachable(addrs []netip.Addr) ([]netip.Addr, error) {
+	if e == nil || !e.addr.IsValid() {
+		return addrs, nil
+	}
+	var matching []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() == e.addr.Is4() {
+			matching = append(matching, addr)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("%w (%s)", errEgressFamily, e.addr)
+	}
+	return matching, nil
+}
+
+// listNetworkInterfaces returns the interfaces that can carry outbound
+// traffic, with their addresses
+func listNetworkInterfaces() ([]NetworkInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	list := []NetworkInterface{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		info := NetworkInterface{Name: iface.Name, Up: iface.Flags&net.FlagUp != 0, Addresses: []string{}}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				info.Addresses = append(info.Addresses, ipNet.IP.String())
+			}
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import "syscall"
+
+// bindToDeviceSupported reports whether egress interfaces can be bound by name
+const bindToDeviceSupported = true
+
+// bindToDevice pins a socket to a network interface with SO_BINDTODEVICE
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDeviceSupported reports whether egress interfaces can be bound by name
+const bindToDeviceSupported = false
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return errors.New("binding to an interface is not supported on this platform")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// envProxy picks upstreams from A's HTTP_PROXY / HTTPS_PROXY / NO_PROXY
+// environment variables (or their lowercase forms) with the usual semantics,
+// including CIDR and host:port NO_PROXY entries
+type envProxy struct {
+	config *httpproxy.Config
+	find   func(*url.URL) (*url.URL, error)
+}
+
+func newEnvProxy() *envProxy {
+	config := httpproxy.FromEnvironment()
+	return &envProxy{config: config, find: config.ProxyFunc()}
+}
+
+// upstream returns the proxy URL for a destination, "" for a direct connection
+func (e *envProxy) upstream(target *url.URL) (string, error) {
+	proxyURL, err := e.find(target)
+	if err != nil || proxyURL == nil {
+		return "", err
+	}
+	return proxyURL.String(), nil
+}
+
+// String describes the environment for the startup log without credentials
+func (e *envProxy) String() string {
+	var parts []string
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", e.config.HTTPProxy},
+		{"HTTPS_PROXY", e.config.HTTPSProxy},
+		{"NO_PROXY", e.config.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		value := v.value
+		if v.name != "NO_PROXY" {
+			value = routeName(value)
+		}
+		parts = append(parts, v.name+"="+value)
+	}
+	if len(parts) == 0 {
+		return "no proxy variables set, connecting directly"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logEnvProxy reports the upstreams the environment resolves to at startup
+func (p *ProxyServer) logEnvProxy() {
+	p.log(LevelInfo, fmt.Sprintf("Using environment proxy: %s", p.envProxy))
+	for _, target := range []*url.URL{
+		{Scheme: "http", Host: "api.anthropic.com"},
+		{Scheme: "https", Host: "api.anthropic.com"},
+	} {
+		upstream, err := p.envProxy.upstream(target)
+		if err != nil {
+			p.log(LevelError, fmt.Sprintf("Invalid environment proxy for %s: %v", target.Scheme, err))
+			continue
+		}
+		p.log(LevelInfo, fmt.Sprintf("Environment proxy for %s: %s", target, routeName(upstream)))
+	}
+}
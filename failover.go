@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHealthCheckTarget is CONNECTed to through each upstream
+	defaultHealthCheckTarget = "api.anthropic.com:443"
+	// defaultHealthCheckInterval is the time between two health checks
+	defaultHealthCheckInterval = 30 * time.Second
+	// healthCheckTimeout bounds one health check, including the dial and
+	// handshake through an upstream
+	healthCheckTimeout = 10 * time.Second
+	// healthHistoryLimit is the number of checks kept per upstream
+	healthHistoryLimit = 20
+	// latencySamples is the number of recent successful checks averaged
+	// when upstreams are picked by latency
+	latencySamples = 5
+	// unmeasuredLatency sorts upstreams without a successful check last
+	unmeasuredLatency = time.Duration(math.MaxInt64)
+)
+
+// HealthSample is the result of one health check
+type HealthSample struct {
+	Time      string `json:"time"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// UpstreamStatus is the health of one configured upstream for the frontend
+type UpstreamStatus struct {
+	Name      string         `json:"name"`
+	Checked   bool           `json:"checked"`
+	Healthy   bool           `json:"healthy"`
+	LatencyMs int64          `json:"latency_ms"` // average of the recent successful checks
+	History   []HealthSample `json:"history"`    // oldest first
+}
+
+// upstreamEntry is one upstream of the failover list
+type upstreamEntry struct {
+	url     string // "" for DIRECT
+	checked bool
+	healthy bool
+	history []HealthSample
+}
+
+// latency averages the recent successful checks
+func (e *upstreamEntry) latency() time.Duration {
+	var total time.Duration
+	samples := 0
+	for i := len(e.history) - 1; i >= 0 && samples < latencySamples; i-- {
+		if e.history[i].OK {
+			total += time.Duration(e.history[i].LatencyMs) * time.Millisecond
+			samples++
+		}
+	}
+	if samples == 0 {
+		return unmeasuredLatency
+	}
+	return total / time.Duration(samples)
+}
+
+// upstreamPool is a record's ordered failover list of upstream proxies. A
+// background health check CONNECTs to a probe target through each of them;
+// requests go to the healthy ones first, in list order or fastest first.
+type upstreamPool struct {
+	entries  []*upstreamEntry
+	latency  bool
+	target   string
+	interval time.Duration
+
+	mu       sync.Mutex
+	current  string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newUpstreamPool parses the record's failover list; it returns nil when the
+// record uses the single HTTP / HTTPS proxy settings
+func newUpstreamPool(settings ProxySettings) (*upstreamPool, error) {
+	pool := &upstreamPool{
+		target:   defaultHealthCheckTarget,
+		interval: defaultHealthCheckInterval,
+		stop:     make(chan struct{}),
+	}
+	for _, line := range settings.UpstreamProxies {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.EqualFold(line, "DIRECT"):
+			line = ""
+		default:
+			if _, err := parseUpstreamProxy(line); err != nil {
+				return nil, fmt.Errorf("invalid upstream proxy %s: %w", routeName(line), err)
+			}
+		}
+		pool.entries = append(pool.entries, &upstreamEntry{url: line})
+	}
+	if len(pool.entries) == 0 {
+		return nil, nil
+	}
+
+	switch settings.UpstreamSelection {
+	case "", "order":
+	case "latency":
+		pool.latency = true
+	default:
+		return nil, fmt.Errorf("invalid upstream selection %q: want order or latency", settings.UpstreamSelection)
+	}
+	if target := strings.TrimSpace(settings.HealthCheckTarget); target != "" {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "443")
+		}
+		pool.target = target
+	}
+	if settings.HealthCheckInterval > 0 {
+		pool.interval = time.Duration(settings.HealthCheckInterval) * time.Second
+	}
+	return pool, nil
+}
+
+// order returns the upstreams to try: healthy (or not yet checked) ones
+// first, failed ones last as a final resort
+func (u *upstreamPool) order() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.orderLocked()
+}
+
+func (u *upstreamPool) orderLocked() []string {
+	var healthy, failed []*upstreamEntry
+	for _, e := range u.entries {
+		if !e.checked || e.healthy {
+			healthy = append(healthy, e)
+		} else {
+			failed = append(failed, e)
+		}
+	}
+	if u.latency {
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].latency() < healthy[j].latency() })
+	}
+	urls := make([]string, 0, len(u.entries))
+	for _, e := range append(healthy, failed...) {
+		urls = append(urls, e.url)
+	}
+	return urls
+}
+
+// record stores a health check result and reports whether the upstream
+// changed between healthy and failed; a first check counts when it fails
+func (u *upstreamPool) record(e *upstreamEntry, sample HealthSample) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	changed := e.healthy != sample.OK && (e.checked || !sample.OK)
+	e.checked = true
+	e.healthy = sample.OK
+	e.history = append(e.history, sample)
+	if len(e.history) > healthHistoryLimit {
+		e.history = e.history[len(e.history)-healthHistoryLimit:]
+	}
+	return changed
+}
+
+// updateCurrent recomputes the preferred upstream and reports whether it changed
+func (u *upstreamPool) updateCurrent() (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	previous := u.current
+	u.current = u.orderLocked()[0]
+	return u.current, previous != u.current
+}
+
+// status lists the upstreams in configured order and names the preferred one
+func (u *upstreamPool) status() (string, []UpstreamStatus) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	list := make([]UpstreamStatus, 0, len(u.entries))
+	for _, e := range u.entries {
+		status := UpstreamStatus{
+			Name:    routeName(e.url),
+			Checked: e.checked,
+			Healthy: e.healthy,
+			History: append([]HealthSample(nil), e.history...),
+		}
+		if latency := e.latency(); latency != unmeasuredLatency {
+			status.LatencyMs = latency.Milliseconds()
+		}
+		list = append(list, status)
+	}
+	return routeName(u.orderLocked()[0]), list
+}
+
+func (u *upstreamPool) close() {
+	u.stopOnce.Do(func() { close(u.stop) })
+}
+
+// checkUpstreams runs the health checks until the pool is closed
+func (p *ProxyServer) checkUpstreams(pool *upstreamPool) {
+	p.log(LevelInfo, fmt.Sprintf("Checking %d upstream(s) via %s every %s", len(pool.entries), pool.target, pool.interval))
+	ticker := time.NewTicker(pool.interval)
+	defer ticker.Stop()
+	for {
+		p.probeUpstreams(pool)
+		select {
+		case <-pool.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeUpstreams checks all upstreams in parallel
+func (p *ProxyServer) probeUpstreams(pool *upstreamPool) {
+	var wg sync.WaitGroup
+	for _, e := range pool.entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sample := p.probeUpstream(e.url, pool.target)
+			if !pool.record(e, sample) {
+				return
+			}
+			if sample.OK {
+				p.log(LevelInfo, fmt.Sprintf("Upstream %s is healthy again (%dms)", routeName(e.url), sample.LatencyMs))
+			} else {
+				p.log(LevelError, fmt.Sprintf("Upstream %s failed its health check: %s", routeName(e.url), sample.Error))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if current, changed := pool.updateCurrent(); changed {
+		p.log(LevelInfo, fmt.Sprintf("Using upstream %s", routeName(current)))
+	}
+}
+
+// probeUpstream CONNECTs to target through one upstream and times it
+func (p *ProxyServer) probeUpstream(upstream, target string) HealthSample {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if upstream == "" {
+		conn, err = p.dialDirect(ctx, target)
+	} else {
+		conn, err = p.dialThroughProxy(ctx, upstream, target)
+	}
+	sample := HealthSample{
+		Time:      start.Format(time.RFC3339),
+		OK:        err == nil,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		sample.Error = err.Error()
+	} else {
+		conn.Close()
+	}
+	return sample
+}
+
+// UpstreamStatus returns the preferred upstream and the health of each
+// upstream of the failover list; both are empty without a failover list
+func (p *ProxyServer) UpstreamStatus() (string, []UpstreamStatus) {
+	p.mu.Lock()
+	pool := p.upstreams
+	p.mu.Unlock()
+	if pool == nil {
+		return "", nil
+	}
+	return pool.status()
+}
@@ -5,6 +5,55 @@ let logPollInterval = null;
 let records = [];
 let activeRecordId = null;
 
+// Per-record proxy settings (ProxySettings in config.go), mapped to form fields.
+// type "lines" is a textarea holding one list entry per line.
+const proxySettingFields = [
+    { id: 'proxyUsers', key: 'proxy_users', type: 'lines' },
+    { id: 'upstreamCAFile', key: 'upstream_ca_file', type: 'text' },
+    { id: 'upstreamCertFile', key: 'upstream_cert_file', type: 'text' },
+    { id: 'upstreamKeyFile', key: 'upstream_key_file', type: 'text' },
+    { id: 'upstreamServerName', key: 'upstream_server_name', type: 'text' },
+    { id: 'pacURL', key: 'pac_url', type: 'text' },
+    { id: 'useEnvironmentProxy', key: 'use_environment_proxy', type: 'checkbox' },
+    { id: 'reverseProxy', key: 'reverse_proxy', type: 'checkbox' },
+    { id: 'reversePrefix', key: 'reverse_prefix', type: 'text' },
+    { id: 'upstreamProxies', key: 'upstream_proxies', type: 'lines' },
+    { id: 'upstreamSelection', key: 'upstream_selection', type: 'text' },
+    { id: 'healthCheckTarget', key: 'health_check_target', type: 'text' },
+    { id: 'healthCheckInterval', key: 'health_check_interval', type: 'number' },
+    { id: 'policyRules', key: 'policy_rules', type: 'lines' },
+    { id: 'policyPreset', key: 'policy_preset', type: 'text' },
+    { id: 'routeRules', key: 'route_rules', type: 'lines' },
+    { id: 'allowPrivateNetworks', key: 'allow_private_networks', type: 'lines' },
+    { id: 'dnsServer', key: 'dns_server', type: 'text' },
+    { id: 'dnsHosts', key: 'dns_hosts', type: 'lines' },
+    { id: 'egressAddress', key: 'egress_address', type: 'text' },
+    { id: 'egressInterface', key: 'egress_interface', type: 'text' },
+    { id: 'maxIdleConns', key: 'max_idle_conns', type: 'number' },
+    { id: 'maxIdleConnsPerHost', key: 'max_idle_conns_per_host', type: 'number' },
+    { id: 'idleConnTimeout', key: 'idle_conn_timeout', type: 'number' },
+    { id: 'dialTimeout', key: 'dial_timeout', type: 'number' },
+    { id: 'tlsHandshakeTimeout', key: 'tls_handshake_timeout', type: 'number' },
+    { id: 'responseHeaderTimeout', key: 'response_header_timeout', type: 'number' },
+    { id: 'streamIdleTimeout', key: 'stream_idle_timeout', type: 'number' },
+    { id: 'tunnelIdleTimeout', key: 'tunnel_idle_timeout', type: 'number' },
+    { id: 'maxConnLifetime', key: 'max_conn_lifetime', type: 'number' },
+    { id: 'timeoutRules', key: 'timeout_rules', type: 'lines' },
+    { id: 'drainTimeout', key: 'drain_timeout', type: 'number' },
+    { id: 'maxConnections', key: 'max_connections', type: 'number' },
+    { id: 'maxConnectionsPerHost', key: 'max_connections_per_host', type: 'number' },
+    { id: 'limitWait', key: 'limit_wait', type: 'number' },
+    { id: 'requestsPerSecond', key: 'requests_per_second', type: 'number' },
+    { id: 'clientRequestsPerSecond', key: 'client_requests_per_second', type: 'number' },
+    { id: 'requestBurst', key: 'request_burst', type: 'number' },
+    { id: 'bandwidthLimit', key: 'bandwidth_limit', type: 'number' },
+    { id: 'clientBandwidthLimit', key: 'client_bandwidth_limit', type: 'number' },
+    { id: 'priorityHosts', key: 'priority_hosts', type: 'lines' },
+    { id: 'tunnelBandwidth', key: 'tunnel_bandwidth', type: 'number' },
+    { id: 'addViaHeader', key: 'add_via_header', type: 'checkbox' },
+    { id: 'addForwardedFor', key: 'add_forwarded_for', type: 'checkbox' },
+];
+
 function showMessage(text, type) {
     const msg = document.getElementById('message');
     msg.textContent = text;
@@ -26,11 +75,59 @@ function getConfig() {
         http_proxy: document.getElementById('httpProxy').value,
         https_proxy: document.getElementById('httpsProxy').value,
         log_level: document.getElementById('logLevel').value,
+        ...readProxySettings(),
     };
 }
 
+function readProxySettings() {
+    const settings = {};
+    proxySettingFields.forEach(field => {
+        const el = document.getElementById(field.id);
+        if (!el) {
+            return;
+        }
+        switch (field.type) {
+            case 'lines':
+                settings[field.key] = el.value.split('\n').map(line => line.trim()).filter(line => line);
+                break;
+            case 'number':
+                settings[field.key] = parseInt(el.value) || 0;
+                break;
+            case 'checkbox':
+                settings[field.key] = el.checked;
+                break;
+            default:
+                settings[field.key] = el.value.trim();
+        }
+    });
+    return settings;
+}
+
+function applyProxySettings(source) {
+    proxySettingFields.forEach(field => {
+        const el = document.getElementById(field.id);
+        if (!el) {
+            return;
+        }
+        const value = source[field.key];
+        switch (field.type) {
+            case 'lines':
+                el.value = (value || []).join('\n');
+                break;
+            case 'number':
+                el.value = value || '';
+                break;
+            case 'checkbox':
+                el.checked = !!value;
+                break;
+            default:
+                el.value = value || '';
+        }
+    });
+}
+
 function setFormDisabled(disabled) {
-    document.querySelectorAll('#configForm input').forEach(input => {
+    document.querySelectorAll('#configForm input, #configForm textarea, #policyPreset, #upstreamSelection').forEach(input => {
         input.disabled = disabled;
     });
     const recordSelect = document.getElementById('recordSelect');
@@ -119,6 +216,17 @@ async function updateStatus() {
             tunnelText.textContent = 'SSH 隧道 (未连接)';
         }
 
+        const drainItem = document.getElementById('drainStatusItem');
+        if (status.draining) {
+            drainItem.style.display = 'flex';
+            document.getElementById('drainStatusText').textContent =
+                '正在排空 (' + status.draining_connections + ' 个连接)';
+        } else {
+            drainItem.style.display = 'none';
+        }
+
+        updateUpstreams(status);
+
         // Update button state based on tunnel status
         if (status.tunnel_running && !isRunning) {
             updateButtons(true);
@@ -131,6 +239,30 @@ async function updateStatus() {
     }
 }
 
+function updateUpstreams(status) {
+    const card = document.getElementById('upstreamCard');
+    if (!status.upstreams || status.upstreams.length === 0) {
+        card.style.display = 'none';
+        return;
+    }
+    card.style.display = 'block';
+    document.getElementById('upstreamList').innerHTML = status.upstreams.map(upstream => {
+        let state = '检测中';
+        if (upstream.checked) {
+            state = upstream.healthy ? '正常' : '故障';
+        }
+        if (upstream.name === status.upstream) {
+            state += ' (使用中)';
+        }
+        const history = (upstream.history || []).map(sample =>
+            '<span title="' + escapeHtml(sample.time + ' ' + (sample.ok ? sample.latency_ms + 'ms' : sample.error)).replace(/"/g, '&quot;') +
+            '" style="color: ' + (sample.ok ? '#34c759' : '#ff3b30') + ';">●</span>'
+        ).join('');
+        return '<tr><td>' + escapeHtml(upstream.name) + '</td><td>' + state + '</td><td>' +
+            (upstream.latency_ms ? upstream.latency_ms + ' ms' : '-') + '</td><td>' + history + '</td></tr>';
+    }).join('');
+}
+
 async function updateLogs() {
     try {
         const logs = await window.go.main.App.GetLogs();
@@ -157,6 +289,121 @@ async function updateLogs() {
     }
 }
 
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let value = bytes || 0;
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    return (unit === 0 ? value : value.toFixed(1)) + ' ' + units[unit];
+}
+
+async function updateTraffic() {
+    try {
+        const stats = await window.go.main.App.GetTrafficStats();
+        const totals = stats.totals || {};
+        document.getElementById('trafficUp').textContent = formatBytes(totals.bytes_up);
+        document.getElementById('trafficDown').textContent = formatBytes(totals.bytes_down);
+        document.getElementById('trafficRequests').textContent = totals.requests || 0;
+        document.getElementById('trafficActive').textContent = stats.active || 0;
+        document.getElementById('trafficFailed').textContent = (totals.errors || 0) + ' / ' + (totals.denied || 0) + ' / ' + (totals.limited || 0);
+
+        const hosts = stats.hosts || [];
+        const tbody = document.getElementById('trafficHosts');
+        if (hosts.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="4" class="traffic-empty">暂无流量</td></tr>';
+            return;
+        }
+        tbody.innerHTML = hosts.map(host => '<tr><td>' + (host.name === '(other)' ? '其他主机' : escapeHtml(host.name)) + '</td><td>' + host.requests +
+            '</td><td>' + formatBytes(host.bytes_up) + '</td><td>' + formatBytes(host.bytes_down) + '</td></tr>').join('');
+    } catch (err) {
+        console.error('Traffic update error:', err);
+    }
+}
+
+const connectionStates = {
+    connecting: '连接中',
+    open: '已建立',
+    closing: '关闭中'
+};
+
+function formatDuration(ms) {
+    const seconds = Math.floor((ms || 0) / 1000);
+    if (seconds < 60) {
+        return seconds + 's';
+    }
+    if (seconds < 3600) {
+        return Math.floor(seconds / 60) + 'm' + (seconds % 60) + 's';
+    }
+    return Math.floor(seconds / 3600) + 'h' + Math.floor((seconds % 3600) / 60) + 'm';
+}
+
+async function updateConnections() {
+    try {
+        const conns = await window.go.main.App.GetConnections();
+        const tbody = document.getElementById('connectionList');
+        if (!conns || conns.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="8" class="traffic-empty">暂无连接</td></tr>';
+            return;
+        }
+        tbody.innerHTML = conns.map(conn => {
+            const client = (conn.tunneled ? 'B ' : '') + conn.client + (conn.user ? ' (' + conn.user + ')' : '');
+            const target = escapeHtml(conn.target) + (conn.priority ? ' (优先)' : '');
+            return '<tr><td>' + target + '</td><td>' + escapeHtml(client) + '</td><td>' + conn.kind +
+                '</td><td>' + (connectionStates[conn.state] || conn.state) + '</td><td>' + formatDuration(conn.duration_ms) +
+                '</td><td>' + formatBytes(conn.bytes_up) + '</td><td>' + formatBytes(conn.bytes_down) +
+                '</td><td><button type="button" class="copy-btn" onclick="closeConnection(' + conn.id + ')">关闭</button></td></tr>';
+        }).join('');
+    } catch (err) {
+        console.error('Connections update error:', err);
+    }
+}
+
+async function closeConnection(id) {
+    try {
+        await window.go.main.App.CloseConnection(id);
+        updateConnections();
+    } catch (err) {
+        showMessage('关闭连接失败: ' + err, 'error');
+    }
+}
+
+async function closeAllConnections() {
+    try {
+        await window.go.main.App.CloseAllConnections();
+        updateConnections();
+    } catch (err) {
+        showMessage('关闭连接失败: ' + err, 'error');
+    }
+}
+
+async function listInterfaces() {
+    try {
+        const ifaces = await window.go.main.App.ListNetworkInterfaces();
+        const tbody = document.getElementById('interfaceList');
+        const pick = (field, value) => '<button type="button" class="copy-btn" data-field="' + field +
+            '" data-value="' + escapeHtml(value).replace(/"/g, '&quot;') + '">' + escapeHtml(value) + '</button>';
+        if (!ifaces || ifaces.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="2" class="traffic-empty">没有可用的网卡</td></tr>';
+        } else {
+            tbody.innerHTML = ifaces.map(iface =>
+                '<tr><td>' + pick('egressInterface', iface.name) + (iface.up ? '' : ' (未启用)') +
+                '</td><td>' + iface.addresses.map(addr => pick('egressAddress', addr)).join(' ') + '</td></tr>'
+            ).join('');
+        }
+        tbody.querySelectorAll('button[data-field]').forEach(btn => {
+            btn.addEventListener('click', () => {
+                document.getElementById(btn.dataset.field).value = btn.dataset.value;
+            });
+        });
+        document.getElementById('interfaceTable').style.display = '';
+    } catch (err) {
+        showMessage('获取网卡列表失败: ' + err, 'error');
+    }
+}
+
 function escapeHtml(text) {
     const div = document.createElement('div');
     div.textContent = text;
@@ -261,6 +508,7 @@ function applyRecordToForm(record) {
     document.getElementById('httpProxy').value = record.http_proxy || '';
     document.getElementById('httpsProxy').value = record.https_proxy || '';
     document.getElementById('logLevel').value = record.log_level || 'INFO';
+    applyProxySettings(record);
     updateCommandPorts(record.remote_port || 8080);
 }
 
@@ -274,12 +522,19 @@ function applyConfigToForm(config) {
     if (config.https_proxy) document.getElementById('httpsProxy').value = config.https_proxy;
     const remotePort = config.remote_port || 8080;
     if (config.remote_port) document.getElementById('remotePort').value = config.remote_port;
+    applyProxySettings(config);
     updateCommandPorts(remotePort);
 }
 
 function updateCommandPorts(port) {
     document.getElementById('cmdPort').textContent = port;
     document.getElementById('cmdPort2').textContent = port;
+    document.getElementById('cmdPort3').textContent = port;
+    document.getElementById('cmdPort4').textContent = port;
+    const prefix = document.getElementById('reversePrefix').value.trim() || '/anthropic';
+    document.getElementById('cmdPrefix').textContent = prefix.replace(/\/+$/, '');
+    document.getElementById('reverseCmdSection').style.display =
+        document.getElementById('reverseProxy').checked ? 'block' : 'none';
 }
 
 function buildRecordFromForm() {
@@ -294,7 +549,8 @@ function buildRecordFromForm() {
         proxy_port: config.proxy_port,
         remote_port: config.remote_port,
         http_proxy: config.http_proxy,
-        https_proxy: config.https_proxy
+        https_proxy: config.https_proxy,
+        ...readProxySettings(),
     };
 }
 
@@ -309,6 +565,7 @@ function resetNewRecordForm() {
     document.getElementById('remotePort').value = 8080;
     document.getElementById('httpProxy').value = '';
     document.getElementById('httpsProxy').value = '';
+    applyProxySettings({});
     updateCommandPorts(8080);
     renderRecordSelect();
 }
@@ -371,6 +628,10 @@ document.addEventListener('DOMContentLoaded', () => {
     loadConfig();
     updateStatus();
     setInterval(updateStatus, 2000);
+    updateTraffic();
+    setInterval(updateTraffic, 2000);
+    updateConnections();
+    setInterval(updateConnections, 2000);
     const recordSelect = document.getElementById('recordSelect');
     if (recordSelect) {
         recordSelect.addEventListener('change', async (event) => {
@@ -402,3 +663,6 @@ window.newRecord = newRecord;
 window.saveRecord = saveRecord;
 window.deleteRecord = deleteRecord;
 window.clearLogs = clearLogs;
+window.closeConnection = closeConnection;
+window.closeAllConnections = closeAllConnections;
+window.listInterfaces = listInterfaces;
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders apply to a single connection and are never forwarded
+// (RFC 9110 section 7.6.1, plus the de-facto Proxy-Connection and Keep-Alive)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including any field
+// named in Connection
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// newViaToken returns the pseudonym this proxy instance adds to Via. It is
+// unique per instance so chained copies of this app are not taken for a loop.
+func newViaToken() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return "claude-proxy-" + hex.EncodeToString(id)
+}
+
+// viaValue formats our Via entry for a message of the given protocol version
+func (p *ProxyServer) viaValue(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d %s", major, p.viaToken)
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, p.viaToken)
+}
+
+// loopHeader carries our Via token to upstream proxies whether or not Via
+// is enabled. It is listed in Connection, so a compliant upstream drops it
+// instead of passing it on, while a request routed back to us still has it.
+const loopHeader = "Claude-Proxy-Loop"
+
+// isLoop reports whether a request already passed through this proxy
+func (p *ProxyServer) isLoop(h http.Header) bool {
+	for _, value := range h.Values(loopHeader) {
+		if strings.TrimSpace(value) == p.viaToken {
+			return true
+		}
+	}
+	for _, value := range h.Values("Via") {
+		for _, entry := range strings.Split(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && fields[1] == p.viaToken {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addLoopMarker adds loopHeader to a request for an upstream proxy
+func (p *ProxyServer) addLoopMarker(h http.Header) {
+	h.Set(loopHeader, p.viaToken)
+	h.Add("Connection", loopHeader)
+}
+
+// markForUpstream adds the loop marker to a plain-HTTP request that an HTTP
+// upstream proxy will read. https requests are marked on the CONNECT.
+func (p *ProxyServer) markForUpstream(req *http.Request, upstream string) *http.Request {
+	if upstream == "" || req.URL.Scheme != "http" {
+		return req
+	}
+	if parsed, err := parseUpstreamProxy(upstream); err != nil || parsed.isSOCKS() {
+		return req
+	}
+	out := req.Clone(req.Context())
+	p.addLoopMarker(out.Header)
+	return out
+}
+
+// addForwardedFor appends the client address to X-Forwarded-For and
+// Forwarded. For connections that came through the SSH tunnel that is the
+// address on B, not the tunnel endpoint.
+func (p *ProxyServer) addForwardedFor(h http.Header, r *http.Request) {
+	remote := r.RemoteAddr
+	if origin, ok := p.origins.lookup(remote); ok {
+		remote = origin
+	}
+	client, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return
+	}
+
+	if prior := h.Get("X-Forwarded-For"); prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+client)
+	} else {
+		h.Set("X-Forwarded-For", client)
+	}
+
+	node := client
+	if strings.Contains(client, ":") {
+		node = `"[` + client + `]"` // IPv6 must be quoted (RFC 7239)
+	}
+	forwarded := fmt.Sprintf("for=%s;host=%q;proto=%s", node, r.Host, forwardedProto(r))
+	if prior := h.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Set("Forwarded", forwarded)
+}
+
+func forwardedProto(r *http.Request) string {
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	return "http"
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestLoopDetectedWithoutViaHeader(t *testing.T) {
+	config := loopbackConfig()
+	config.ProxyPort = freePort(t)
+	self := fmt.Sprintf("http://127.0.0.1:%d", config.ProxyPort)
+	config.HTTPProxy = self
+	config.HTTPSProxy = self
+	config.DNSHosts = []string{"198.51.100.1 example.com"} // a local upstream gets named targets checked
+	p := startTestProxy(t, config)
+
+	client := proxyClient(p)
+	client.Timeout = 5 * time.Second // an undetected loop never answers
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("HTTP request through ourselves: got %s, want 508", resp.Status)
+	}
+
+	conn, err := net.Dial("tcp", p.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The inner CONNECT is refused; the outer one reports the upstream's answer
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "508 Loop Detected") {
+		t.Errorf("CONNECT through ourselves: got %s %q, want the loop reported", resp.Status, body)
+	}
+}
+
+func TestForwardedForUsesTunnelOrigin(t *testing.T) {
+	got := make(chan http.Header, 1)
+	origin := newOrigin(t)
+	origin.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+	})
+	config := loopbackConfig()
+	config.AddForwardedFor = true
+	p := startTestProxy(t, config)
+	p.origins = newClientOrigins()
+
+	conn, err := net.Dial("tcp", p.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p.origins.add(conn.LocalAddr().String(), "192.0.2.10:51000")
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	header := <-got
+	if xff := header.Get("X-Forwarded-For"); xff != "192.0.2.10" {
+		t.Errorf("X-Forwarded-For = %q, want the tunnel origin 192.0.2.10", xff)
+	}
+	if fwd := header.Get("Forwarded"); !strings.HasPrefix(fwd, "for=192.0.2.10;") {
+		t.Errorf("Forwarded = %q", fwd)
+	}
+}
+
+func TestUpstreamRequestsCarryHopByHopLoopMarker(t *testing.T) {
+	seen := make(chan http.Header, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(upstream.Close)
+
+	config := loopbackConfig()
+	config.HTTPProxy = upstream.URL
+	config.HTTPSProxy = upstream.URL
+	config.DNSHosts = []string{"198.51.100.1 example.com"}
+	p := startTestProxy(t, config)
+
+	if resp, err := proxyClient(p).Get("http://example.com/"); err == nil {
+		resp.Body.Close()
+	}
+	conn, err := net.Dial("tcp", p.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+
+	for _, request := range []string{"GET", "CONNECT"} {
+		header := <-seen
+		if via := header.Get("Via"); via != "" {
+			t.Errorf("%s: Via %q sent with AddViaHeader off", request, via)
+		}
+		if header.Get(loopHeader) != p.viaToken || !strings.Contains(strings.Join(header.Values("Connection"), ","), loopHeader) {
+			t.Errorf("%s: loop marker missing or not hop-by-hop: %v", request, header)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errTooManyConnections is returned when a concurrency limit is reached
+var errTooManyConnections = errors.New("too many concurrent connections")
+
+// errRateLimited is returned when a request rate limit is exceeded
+var errRateLimited = errors.New("request rate limit exceeded")
+
+// limitError says which limit rejected an exchange and when to retry
+type limitError struct {
+	err        error
+	scope      string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%v (%s)", e.err, e.scope)
+}
+
+func (e *limitError) Unwrap() error {
+	return e.err
+}
+
+// status is the HTTP status reported for the rejected request
+func (e *limitError) status() int {
+	if errors.Is(e.err, errRateLimited) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+// retryAfterSeconds formats retryAfter for the Retry-After header
+func (e *limitError) retryAfterSeconds() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(e.retryAfter.Seconds()))))
+}
+
+// rateLimiter is a token bucket. Takers may go into debt so that a large
+// read is paid for by a longer wait rather than never fitting the bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil for a zero rate; a nil limiter never waits
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = math.Max(1, rate)
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long the caller has to wait for them
+func (l *rateLimiter) reserve(n float64) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// charge takes n tokens without waiting, but never leaves more than
+// maxDebt worth of tokens owed
+func (l *rateLimiter) charge(n float64, maxDebt time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.tokens = math.Max(l.tokens-n, -maxDebt.Seconds()*l.rate)
+}
+
+// take takes one token if it is available within maxWait. Otherwise it
+// takes nothing and reports how long until one would be.
+func (l *rateLimiter) take(maxWait time.Duration) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	wait := time.Duration(0)
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// clientLimits are the rate limits of one authenticated client
+type clientLimits struct {
+	requests  *rateLimiter
+	bandwidth *rateLimiter
+}
+
+// proxyLimits enforces the record's concurrency, request rate and
+// bandwidth limits. Zero settings disable the corresponding limit.
+type proxyLimits struct {
+	maxConns    int
+	maxPerHost  int
+	wait        time.Duration // how long an exchange may queue for a limit
+	requests    *rateLimiter
+	bandwidth   *rateLimiter
+	clientRate  float64
+	clientBurst float64
+	clientBytes float64
+
+	mu       sync.Mutex
+	total    int
+	hosts    map[string]int
+	clients  map[string]*clientLimits
+	released chan struct{} // closed and replaced whenever a slot frees up
+}
+
+func newProxyLimits(settings ProxySettings) *proxyLimits {
+	return &proxyLimits{
+		maxConns:    settings.MaxConnections,
+		maxPerHost:  settings.MaxConnectionsPerHost,
+		wait:        time.Duration(settings.LimitWait) * time.Second,
+		requests:    newRateLimiter(float64(settings.RequestsPerSecond), float64(settings.RequestBurst)),
+		bandwidth:   newRateLimiter(float64(settings.BandwidthLimit)*1024, 0),
+		clientRate:  float64(settings.ClientRequestsPerSecond),
+		clientBurst: float64(settings.RequestBurst),
+		clientBytes: float64(settings.ClientBandwidthLimit) * 1024,
+		hosts:       make(map[string]int),
+		clients:     make(map[string]*clientLimits),
+		released:    make(chan struct{}),
+	}
+}
+
+// client returns the limiters of an authenticated client; without proxy
+// authentication all clients share the "" entry
+func (l *proxyLimits) client(user string) *clientLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[user]
+	if !ok {
+		c = &clientLimits{
+			requests:  newRateLimiter(l.clientRate, l.clientBurst),
+			bandwidth: newRateLimiter(l.clientBytes, 0),
+		}
+		l.clients[user] = c
+	}
+	return c
+}
+
+// acquire takes a concurrency slot for host, queueing up to l.wait
+func (l *proxyLimits) acquire(ctx context.Context, host string) error {
+	if l.maxConns <= 0 && l.maxPerHost <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		scope := ""
+		switch {
+		case l.maxConns > 0 && l.total >= l.maxConns:
+			scope = fmt.Sprintf("limit %d in total", l.maxConns)
+		case l.maxPerHost > 0 && l.hosts[host] >= l.maxPerHost:
+			scope = fmt.Sprintf("limit %d for %s", l.maxPerHost, host)
+		default:
+			l.total++
+			l.hosts[host]++
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return &limitError{err: errTooManyConnections, scope: scope, retryAfter: time.Second}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees the slot taken by acquire
+func (l *proxyLimits) release(host string) {
+	if l.maxConns <= 0 && l.maxPerHost <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// admit applies the request rate limits and takes a concurrency slot for an
+// exchange. On success the exchange's bytes are throttled by the bandwidth
+// limits and the returned release function must be called when it is over.
+func (p *ProxyServer) admit(ctx context.Context, ex *trafficExchange) (func(), error) {
+	// Killing a queued exchange gives its place back right away
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ex.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client := p.limits.client(ex.user)
+	clientScope := "client"
+	if ex.user != "" {
+		clientScope += " " + ex.user
+	}
+	for _, limit := range []struct {
+		limiter *rateLimiter
+		scope   string
+	}{
+		{p.limits.requests, "record"},
+		{client.requests, clientScope},
+	} {
+		wait, ok := limit.limiter.take(p.limits.wait)
+		if !ok {
+			return nil, &limitError{err: errRateLimited, scope: limit.scope, retryAfter: wait}
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	if err := p.limits.acquire(ctx, ex.host); err != nil {
+		return nil, err
+	}
+	ex.bandwidth = []*rateLimiter{p.limits.bandwidth, client.bandwidth}
+	return func() { p.limits.release(ex.host) }, nil
+}
+
+// throttle waits until n more bytes fit the exchange's bandwidth limits
+func (ex *trafficExchange) throttle(n int) {
+	var wait time.Duration
+	for _, limiter := range ex.bandwidth {
+		if d := limiter.reserve(float64(n)); d > wait {
+			wait = d
+		}
+	}
+	ex.sleep(wait)
+}
+
+// sleep pauses a throttled exchange for d, returning early when it is
+// killed from the connection table, by a drain or by Stop
+func (ex *trafficExchange) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ex.done:
+	}
+}
+
+// rejectLimited answers a plain-HTTP or CONNECT request refused by a limit
+func (p *ProxyServer) rejectLimited(w http.ResponseWriter, ex *trafficExchange, err error) {
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ex.result = trafficLimited
+	w.Header().Set("Retry-After", limitErr.retryAfterSeconds())
+	http.Error(w, limitErr.Error(), limitErr.status())
+	p.log(LevelInfo, fmt.Sprintf("Rejected %s %s%s: %v", ex.kind, ex.target, userSuffix(ex.user), err))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitActive polls until p serves want exchanges or the timeout passes
+func waitActive(t *testing.T, p *ProxyServer, want int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for p.activeConnections() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active exchanges after %s, want %d", p.activeConnections(), timeout, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKillInterruptsThrottledExchange(t *testing.T) {
+	origin := newOrigin(t)
+	config := loopbackConfig()
+	config.BandwidthLimit = 1 // KB/s, so each 4 KB read waits seconds
+	p := startTestProxy(t, config)
+
+	go func() {
+		resp, err := proxyClient(p).Get(origin.URL + "/" + strings.Repeat("x", 64<<10))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	waitActive(t, p, 1, time.Second)
+	time.Sleep(200 * time.Millisecond) // let the exchange reach the throttle
+
+	start := time.Now()
+	if n := p.CloseAllConnections(); n != 1 {
+		t.Fatalf("closed %d exchanges, want 1", n)
+	}
+	waitActive(t, p, 0, time.Second)
+	t.Logf("throttled exchange finished %s after being killed", time.Since(start))
+}
+
+// socks5Request sends a SOCKS5 CONNECT for target without reading the reply
+func socks5Request(t *testing.T, proxy *ProxyServer, target string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte{socks5Version, 1, socksMethodNone})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	addrPort := netip.MustParseAddrPort(target)
+	req := []byte{socks5Version, socksCmdConnect, 0, socksAtypIPv4}
+	req = append(req, addrPort.Addr().AsSlice()...)
+	req = binary.BigEndian.AppendUint16(req, addrPort.Port())
+	conn.Write(req)
+	return conn
+}
+
+func TestQueuedSOCKS5ClientHangupFreesQueue(t *testing.T) {
+	origin := newOrigin(t)
+	config := loopbackConfig()
+	config.MaxConnections = 1
+	config.LimitWait = 30
+	p := startTestProxy(t, config)
+	target := origin.Listener.Addr().String()
+
+	holder := socks5Request(t, p, target)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(holder, reply); err != nil || reply[1] != socksReplySucceeded {
+		t.Fatalf("first SOCKS5 request failed: %v %v", err, reply)
+	}
+
+	queued := socks5Request(t, p, target)
+	waitActive(t, p, 2, time.Second)
+	queued.Close()
+	waitActive(t, p, 1, time.Second)
+
+	// Killing a queued exchange from the connection table works the same way
+	socks5Request(t, p, target)
+	waitActive(t, p, 2, time.Second)
+	for _, info := range p.Connections() {
+		if info.State == connConnecting {
+			p.CloseConnection(info.ID)
+		}
+	}
+	waitActive(t, p, 1, time.Second)
+}
+
+func TestKillInterruptsStuckConnect(t *testing.T) {
+	// An upstream proxy that accepts connections and never answers
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstream.Close() })
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	config := loopbackConfig()
+	config.HTTPSProxy = "http://" + upstream.Addr().String()
+	config.DNSHosts = []string{"198.51.100.1 example.com"} // a local upstream gets named targets checked
+	p := startTestProxy(t, config)
+
+	conn, err := net.Dial("tcp", p.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	waitActive(t, p, 1, time.Second)
+	time.Sleep(100 * time.Millisecond) // let the dial reach the upstream handshake
+
+	if n := p.CloseAllConnections(); n != 1 {
+		t.Fatalf("closed %d exchanges, want 1", n)
+	}
+	waitActive(t, p, 0, time.Second)
+}
+
+func TestQueuedSOCKS5ClientOutlivesHandshakeTimeout(t *testing.T) {
+	defer func(old time.Duration) { socksHandshakeTimeout = old }(socksHandshakeTimeout)
+	socksHandshakeTimeout = 200 * time.Millisecond
+
+	origin := newOrigin(t)
+	config := loopbackConfig()
+	config.MaxConnections = 1
+	config.LimitWait = 30
+	p := startTestProxy(t, config)
+	target := origin.Listener.Addr().String()
+
+	holder := socks5Request(t, p, target)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(holder, reply); err != nil || reply[1] != socksReplySucceeded {
+		t.Fatalf("first SOCKS5 request failed: %v %v", err, reply)
+	}
+
+	// Queue longer than the handshake deadline before a slot frees up
+	queued := socks5Request(t, p, target)
+	waitActive(t, p, 2, time.Second)
+	time.Sleep(3 * socksHandshakeTimeout)
+	holder.Close()
+
+	queued.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(queued, reply); err != nil || reply[1] != socksReplySucceeded {
+		t.Fatalf("queued SOCKS5 request failed: %v %v", err, reply)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM negotiate flags (MS-NLMP 2.2.2.5)
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmNegotiateOEM                     = 0x00000002
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	ntlmClientFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget |
+		ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity |
+		ntlmNegotiate128 | ntlmNegotiate56
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiateMessage builds the type 1 message that starts the handshake
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmClientFlags)
+	// Empty domain and workstation fields
+	return msg
+}
+
+// ntlmChallenge is the part of a type 2 message needed to answer it
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+// parseNTLMChallenge decodes a type 2 message sent by the proxy
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) {
+		return nil, fmt.Errorf("invalid NTLM challenge message")
+	}
+	if binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, fmt.Errorf("unexpected NTLM message type %d", binary.LittleEndian.Uint32(msg[8:]))
+	}
+
+	ch := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+	if len(msg) >= 48 && ch.flags&ntlmNegotiateTargetInfo != 0 {
+		size := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+size > len(msg) {
+			return nil, fmt.Errorf("NTLM target info out of range")
+		}
+		ch.targetInfo = msg[offset : offset+size]
+	}
+	return ch, nil
+}
+
+// ntlmAuthenticateMessage builds the type 3 message with an NTLMv2
+// response. user may be written as DOMAIN\user.
+func ntlmAuthenticateMessage(ch *ntlmChallenge, user, password string) ([]byte, error) {
+	domain := ""
+	if d, u, ok := strings.Cut(user, `\`); ok {
+		domain, user = d, u
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	ntResponse, lmResponse := ntlmV2Responses(user, password, domain, ch.challenge, clientChallenge, ch.targetInfo, time.Now())
+
+	encode := ntlmOEMString
+	if ch.flags&ntlmNegotiateUnicode != 0 {
+		encode = ntlmUnicodeString
+	}
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		encode(domain),
+		encode(user),
+		encode(""), // workstation
+		nil,        // session key
+	}
+
+	const headerSize = 64
+	msg := make([]byte, headerSize)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	offset := headerSize
+	for i, field := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(offset))
+		msg = append(msg, field...)
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], ch.flags&ntlmClientFlags)
+	return msg, nil
+}
+
+// ntlmV2Responses computes the NTLMv2 and LMv2 responses (MS-NLMP 3.3.2)
+func ntlmV2Responses(user, password, domain string, serverChallenge, clientChallenge, targetInfo []byte, now time.Time) ([]byte, []byte) {
+	hash := md4.New()
+	hash.Write(ntlmUnicodeString(password))
+	key := ntlmHMAC(hash.Sum(nil), ntlmUnicodeString(strings.ToUpper(user)+domain))
+
+	// Windows FILETIME: 100ns intervals since 1601-01-01
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(now.Unix()*10000000+int64(now.Nanosecond()/100)+116444736000000000))
+
+	temp := []byte{0x01, 0x01, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	proof := ntlmHMAC(key, append(append([]byte{}, serverChallenge...), temp...))
+	ntResponse := append(proof, temp...)
+	lmResponse := append(ntlmHMAC(key, append(append([]byte{}, serverChallenge...), clientChallenge...)), clientChallenge...)
+	return ntResponse, lmResponse
+}
+
+func ntlmHMAC(key, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func ntlmUnicodeString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], unit)
+	}
+	return b
+}
+
+func ntlmOEMString(s string) []byte {
+	return []byte(s)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	// pacCacheTTL bounds how long a per-host PAC answer is reused, so
+	// time-dependent scripts still take effect
+	pacCacheTTL = 5 * time.Minute
+	// pacEvalTimeout stops runaway scripts
+	pacEvalTimeout = 5 * time.Second
+	// pacDNSTimeout bounds dnsResolve / isResolvable / isInNet lookups
+	pacDNSTimeout = 3 * time.Second
+	// maxPACCacheEntries bounds the number of cached answers
+	maxPACCacheEntries = 1024
+)
+
+// pacResolver evaluates a proxy auto-config script and caches the
+// upstream list it returns per scheme, host and port
+type pacResolver struct {
+	source   string
+	resolver *dnsResolver
+
+	// goja runtimes are not safe for concurrent use, so one evaluation runs
+	// at a time. A DNS helper called by the script holds the lock for up to
+	// pacDNSTimeout; the request's own host is resolved before locking.
+	mu      sync.Mutex
+	vm      *goja.Runtime
+	fn      goja.Callable
+	usesDNS bool // the script calls dnsResolve, isResolvable or isInNet
+
+	cacheMu sync.Mutex
+	cache   map[string]pacCacheEntry
+}
+
+type pacCacheEntry struct {
+	upstreams []string
+	expires   time.Time
+}
+
+// loadPAC fetches a PAC script from an http(s):// or file:// URL, or a
+// local path, and compiles it. The download and myIpAddress go out through
+// the egress binding like every other outbound connection, and the script's
+// DNS helpers use the record's resolver.
+func loadPAC(source string, egress *egressBinding, resolver *dnsResolver) (*pacResolver, error) {
+	script, err := readPACScript(source, egress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PAC script %s: %w", source, err)
+	}
+
+	vm := goja.New()
+	registerPACFunctions(vm, egress, resolver)
+	if _, err := vm.RunString(script); err != nil {
+		return nil, fmt.Errorf("failed to run PAC script %s: %w", source, err)
+	}
+	fn, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("PAC script %s does not define FindProxyForURL", source)
+	}
+
+	return &pacResolver{
+		source:   source,
+		resolver: resolver,
+		vm:       vm,
+		fn:       fn,
+		usesDNS:  strings.Contains(script, "dnsResolve") || strings.Contains(script, "isResolvable") || strings.Contains(script, "isInNet"),
+		cache:    make(map[string]pacCacheEntry),
+	}, nil
+}
+
+func readPACScript(source string, egress *egressBinding) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil || len(u.Scheme) <= 1 {
+		// Plain path (a one-letter scheme is a Windows drive)
+		data, err := os.ReadFile(source)
+		return string(data), err
+	}
+
+	switch u.Scheme {
+	case "file":
+		data, err := os.ReadFile(u.Path)
+		return string(data), err
+	case "http", "https":
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = egress.apply(&net.Dialer{Timeout: 30 * time.Second}, "tcp").DialContext
+		defer transport.CloseIdleConnections()
+		client := &http.Client{Timeout: 30 * time.Second, Transport: transport}
+		resp, err := client.Get(source)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("server returned %s", resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return string(data), err
+	default:
+		return "", fmt.Errorf("unsupported PAC URL scheme %q", u.Scheme)
+	}
+}
+
+// find returns the upstream proxies to try for a request, in order. An
+// empty string stands for DIRECT.
+func (r *pacResolver) find(target *url.URL) ([]string, error) {
+	host := target.Hostname()
+	// Scripts commonly branch on the scheme or port, not only the host
+	key := target.Scheme + "://" + strings.ToLower(target.Host)
+
+	r.cacheMu.Lock()
+	entry, ok := r.cache[key]
+	r.cacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.upstreams, nil
+	}
+
+	if r.usesDNS {
+		// Warm the resolver cache so the script's lookup of the request
+		// host does not wait on the network while holding r.mu
+		ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+		r.resolver.lookup(ctx, host)
+		cancel()
+	}
+	result, err := r.evaluate(target.String(), host)
+	if err != nil {
+		return nil, err
+	}
+	upstreams, err := parsePACResult(result)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store(key, upstreams)
+	return upstreams, nil
+}
+
+// store caches an answer, dropping expired entries (or everything) when
+// the cache is full
+func (r *pacResolver) store(key string, upstreams []string) {
+	now := time.Now()
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	if len(r.cache) >= maxPACCacheEntries {
+		for k, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxPACCacheEntries {
+			clear(r.cache)
+		}
+	}
+	r.cache[key] = pacCacheEntry{upstreams: upstreams, expires: now.Add(pacCacheTTL)}
+}
+
+func (r *pacResolver) evaluate(rawURL, host string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	timer := time.AfterFunc(pacEvalTimeout, func() {
+		r.vm.Interrupt("PAC evaluation timed out")
+	})
+	defer timer.Stop()
+	defer r.vm.ClearInterrupt()
+
+	value, err := r.fn(goja.Undefined(), r.vm.ToValue(rawURL), r.vm.ToValue(host))
+	if err != nil {
+		return "", fmt.Errorf("FindProxyForURL(%q) failed: %w", rawURL, err)
+	}
+	return value.String(), nil
+}
+
+// parsePACResult converts "PROXY a:80; SOCKS b:1080; DIRECT" into upstream
+// URLs understood by parseUpstreamProxy
+func parsePACResult(result string) ([]string, error) {
+	var upstreams []string
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			upstreams = append(upstreams, "")
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid PAC entry %q", entry)
+		}
+
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			// Let the SOCKS server resolve names, as browsers do for PAC proxies
+			scheme = "socks5h"
+		case "SOCKS4":
+			scheme = "socks4a"
+		default:
+			return nil, fmt.Errorf("unsupported PAC entry %q", entry)
+		}
+		upstreams = append(upstreams, scheme+"://"+fields[1])
+	}
+	if len(upstreams) == 0 {
+		// An empty answer means DIRECT
+		upstreams = append(upstreams, "")
+	}
+	return upstreams, nil
+}
+
+// registerPACFunctions installs the helper functions PAC scripts expect
+func registerPACFunctions(vm *goja.Runtime, egress *egressBinding, resolver *dnsResolver) {
+	vm.Set("isPlainHostName", func(host string) bool {
+		return !strings.Contains(host, ".")
+	})
+	vm.Set("dnsDomainIs", func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	})
+	vm.Set("localHostOrDomainIs", func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		if host == hostdom {
+			return true
+		}
+		return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+	})
+	vm.Set("dnsDomainLevels", func(host string) int {
+		return strings.Count(host, ".")
+	})
+	vm.Set("shExpMatch", shExpMatch)
+	vm.Set("isResolvable", func(host string) bool {
+		return pacResolve(resolver, host) != ""
+	})
+	vm.Set("dnsResolve", func(host string) goja.Value {
+		if ip := pacResolve(resolver, host); ip != "" {
+			return vm.ToValue(ip)
+		}
+		return goja.Null()
+	})
+	vm.Set("isInNet", func(host, pattern, mask string) bool {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ip = net.ParseIP(pacResolve(resolver, host))
+		}
+		base := net.ParseIP(pattern).To4()
+		m := net.ParseIP(mask).To4()
+		if ip == nil || ip.To4() == nil || base == nil || m == nil {
+			return false
+		}
+		return ip.To4().Mask(net.IPMask(m)).Equal(base.Mask(net.IPMask(m)))
+	})
+	vm.Set("myIpAddress", func() string {
+		conn, err := egress.apply(&net.Dialer{}, "udp").Dial("udp", "8.8.8.8:53")
+		if err != nil {
+			return "127.0.0.1"
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	})
+	vm.Set("weekdayRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacWeekdayRange(pacArgs(call)))
+	})
+	vm.Set("timeRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacTimeRange(pacArgs(call)))
+	})
+}
+
+// shExpMatch matches a shell expression with "*" and "?" wildcards; unlike
+// path.Match, "*" also spans "/"
+func shExpMatch(str, pattern string) bool {
+	if pattern == "" {
+		return str == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(str); i++ {
+			if shExpMatch(str[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return str != "" && shExpMatch(str[1:], pattern[1:])
+	default:
+		return str != "" && str[0] == pattern[0] && shExpMatch(str[1:], pattern[1:])
+	}
+}
+
+// pacResolve looks host up with the record's resolver, preferring IPv4
+// since PAC scripts compare against dotted quads
+func pacResolve(resolver *dnsResolver, host string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addrs, err := resolver.lookup(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr.String()
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0].String()
+	}
+	return ""
+}
+
+// pacArgs returns the call arguments as strings and reports whether the
+// trailing "GMT" argument was given
+func pacArgs(call goja.FunctionCall) ([]string, bool) {
+	args := make([]string, 0, len(call.Arguments))
+	for _, arg := range call.Arguments {
+		args = append(args, arg.String())
+	}
+	if n := len(args); n > 0 && strings.EqualFold(args[n-1], "GMT") {
+		return args[:n-1], true
+	}
+	return args, false
+}
+
+func pacNow(gmt bool) time.Time {
+	if gmt {
+		return time.Now().UTC()
+	}
+	return time.Now()
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// pacWeekdayRange implements weekdayRange(wd1[, wd2][, "GMT"])
+func pacWeekdayRange(args []string, gmt bool) bool {
+	index := func(day string) int {
+		for i, d := range pacWeekdays {
+			if strings.EqualFold(d, day) {
+				return i
+			}
+		}
+		return -1
+	}
+	if len(args) == 0 {
+		return false
+	}
+	from, to := index(args[0]), index(args[0])
+	if len(args) > 1 {
+		to = index(args[1])
+	}
+	if from < 0 || to < 0 {
+		return false
+	}
+	today := int(pacNow(gmt).Weekday())
+	if from <= to {
+		return from <= today && today <= to
+	}
+	return today >= from || today <= to
+}
+
+// pacTimeRange implements the hour and hour:minute forms of
+// timeRange(h1[, m1][, h2[, m2]][, "GMT"])
+func pacTimeRange(args []string, gmt bool) bool {
+	nums := make([]int, len(args))
+	for i, arg := range args {
+		if _, err := fmt.Sscan(arg, &nums[i]); err != nil {
+			return false
+		}
+	}
+	now := pacNow(gmt)
+	minute := now.Hour()*60 + now.Minute()
+
+	var from, to int
+	switch len(nums) {
+	case 1:
+		return now.Hour() == nums[0]
+	case 2:
+		from, to = nums[0]*60, nums[1]*60+59
+	case 4:
+		from, to = nums[0]*60+nums[1], nums[2]*60+nums[3]
+	default:
+		return false
+	}
+	if from <= to {
+		return from <= minute && minute <= to
+	}
+	return minute >= from || minute <= to
+}
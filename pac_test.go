@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestPAC compiles script with a resolver built from settings
+func loadTestPAC(t *testing.T, script string, settings ProxySettings) *pacResolver {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := newDNSResolver(settings, nil, func(level, msg string) { t.Logf("%s %s", level, msg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac, err := loadPAC(path, nil, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pac
+}
+
+func TestPACFetchUsesEgressBinding(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not usable as a source address here")
+	}
+	probe.Close()
+
+	from := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		from <- host
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`))
+	}))
+	t.Cleanup(server.Close)
+
+	egress := &egressBinding{addr: netip.MustParseAddr("127.0.0.2")}
+	if _, err := loadPAC(server.URL+"/proxy.pac", egress, nil); err != nil {
+		t.Fatal(err)
+	}
+	if host := <-from; host != "127.0.0.2" {
+		t.Fatalf("PAC script fetched from %s, want the egress address 127.0.0.2", host)
+	}
+}
+
+func TestPACCacheKeysOnSchemeAndPort(t *testing.T) {
+	pac := loadTestPAC(t, `function FindProxyForURL(url, host) {
+		if (url.substring(0, 6) == "https:") return "PROXY secure:8080";
+		if (url.indexOf(":8443/") > 0) return "PROXY alt:8080";
+		return "DIRECT";
+	}`, ProxySettings{})
+
+	cases := []struct{ target, want string }{
+		{"http://example.com/", ""},
+		{"https://example.com/", "http://secure:8080"},
+		{"http://example.com:8443/", "http://alt:8080"},
+		{"http://example.com/again", ""},
+	}
+	for _, c := range cases {
+		target, _ := url.Parse(c.target)
+		upstreams, err := pac.find(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(upstreams) != 1 || upstreams[0] != c.want {
+			t.Errorf("%s: got %q, want %q", c.target, upstreams, c.want)
+		}
+	}
+}
+
+func TestPACDNSHelpersUseRecordResolver(t *testing.T) {
+	pac := loadTestPAC(t, `function FindProxyForURL(url, host) {
+		if (isInNet(host, "198.51.100.0", "255.255.255.0")) return "PROXY inside:8080";
+		return "PROXY " + dnsResolve(host) + ":1";
+	}`, ProxySettings{DNSHosts: []string{"198.51.100.7 corp.internal", "203.0.113.9 other.internal"}})
+
+	for target, want := range map[string]string{
+		"http://corp.internal/":  "http://inside:8080",
+		"http://other.internal/": "http://203.0.113.9:1",
+	} {
+		u, _ := url.Parse(target)
+		upstreams, err := pac.find(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(upstreams) != 1 || upstreams[0] != want {
+			t.Errorf("%s: got %q, want %q", target, upstreams, want)
+		}
+	}
+}
+
+func TestPACCacheIsBounded(t *testing.T) {
+	pac := loadTestPAC(t, `function FindProxyForURL(url, host) { return "DIRECT"; }`, ProxySettings{})
+	for i := 0; i < maxPACCacheEntries+10; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://host%d.example/", i))
+		if _, err := pac.find(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(pac.cache); n > maxPACCacheEntries {
+		t.Fatalf("cache holds %d entries, want at most %d", n, maxPACCacheEntries)
+	}
+}
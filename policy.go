@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// errPolicyDenied is returned when a destination is blocked by the policy
+var errPolicyDenied = errors.New("blocked by proxy policy")
+
+// policyPresets are built-in rule sets selectable per record. Preset rules
+// are checked after the record's own rules.
+var policyPresets = map[string][]string{
+	// Only the endpoints Claude Code needs
+	"claude-code": {
+		"allow api.anthropic.com:443",
+		"allow statsig.anthropic.com:443",
+		"allow *.statsig.com:443",
+		"allow sentry.io:443",
+		"allow *.sentry.io:443",
+		"allow claude.ai:443",
+		"allow *.claude.ai:443",
+		"allow registry.npmjs.org:443",
+		"deny *",
+	},
+}
+
+// policyRule is one "allow|deny host[:ports]" line
+type policyRule struct {
+	text  string
+	allow bool
+	destPattern
+}
+
+// destPattern matches destinations by host glob or CIDR and port
+type destPattern struct {
+	glob  string       // host glob, empty when cidr is set
+	cidr  netip.Prefix // matches IP literals and the addresses names resolve to
+	ports []portRange  // empty means any port
+}
+
+type portRange struct {
+	from, to int
+}
+
+// proxyPolicy is an ordered rule list; the first matching rule wins and
+// destinations matching no rule are allowed
+type proxyPolicy struct {
+	rules []policyRule
+	cidr  bool // some rule matches by CIDR, so named destinations are resolved
+}
+
+// policyError explains which rule blocked a destination
+type policyError struct {
+	target     string
+	rule       string
+	unresolved bool // a CIDR rule could not be checked because the name did not resolve
+}
+
+func (e *policyError) Error() string {
+	if e.unresolved {
+		return fmt.Sprintf("%s to %s (rule %q, host could not be resolved)", errPolicyDenied, e.target, e.rule)
+	}
+	return fmt.Sprintf("%s to %s (rule %q)", errPolicyDenied, e.target, e.rule)
+}
+
+func (e *policyError) Unwrap() error {
+	return errPolicyDenied
+}
+
+// newProxyPolicy parses the record's rules followed by the selected preset.
+// It returns nil when there are no rules at all.
+func newProxyPolicy(lines []string, preset string) (*proxyPolicy, error) {
+	if preset != "" {
+		presetRules, ok := policyPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy preset %q", preset)
+		}
+		lines = append(append([]string{}, lines...), presetRules...)
+	}
+
+	policy := &proxyPolicy{}
+	for _, line := range lines {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %w", line, err)
+		}
+		policy.rules = append(policy.rules, rule)
+		policy.cidr = policy.cidr || rule.glob == ""
+	}
+	if len(policy.rules) == 0 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// parsePolicyRule parses "allow *.example.com:443", "deny 10.0.0.0/8",
+// "allow *:80,8000-9000" or "deny [fd00::/8]"
+func parsePolicyRule(line string) (policyRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return policyRule{}, fmt.Errorf("expected \"allow|deny host[:ports]\"")
+	}
+
+	rule := policyRule{text: line}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return policyRule{}, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	dest, err := parseDestPattern(fields[1])
+	if err != nil {
+		return policyRule{}, err
+	}
+	rule.destPattern = dest
+	return rule, nil
+}
+
+// parseDestPattern parses "*.example.com:443", "10.0.0.0/8",
+// "*:80,8000-9000" or "[fd00::/8]"
+func parseDestPattern(spec string) (destPattern, error) {
+	var dest destPattern
+	host, ports := spec, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return destPattern{}, fmt.Errorf("missing ']'")
+		}
+		host, ports = host[1:end], strings.TrimPrefix(host[end+1:], ":")
+	} else if strings.Count(host, ":") == 1 {
+		i := strings.Index(host, ":")
+		host, ports = host[:i], host[i+1:]
+	}
+
+	if strings.Contains(host, "/") {
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return destPattern{}, err
+		}
+		dest.cidr = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(host); err == nil {
+		dest.cidr = netip.PrefixFrom(addr, addr.BitLen())
+	} else {
+		dest.glob = strings.ToLower(host)
+	}
+
+	if ports != "" && ports != "*" {
+		for _, part := range strings.Split(ports, ",") {
+			r, err := parsePortRange(part)
+			if err != nil {
+				return destPattern{}, err
+			}
+			dest.ports = append(dest.ports, r)
+		}
+	}
+	return dest, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(from)
+	if err != nil || start < 1 || start > 65535 {
+		return portRange{}, fmt.Errorf("invalid port %q", from)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.Atoi(to)
+		if err != nil || end < start || end > 65535 {
+			return portRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return portRange{start, end}, nil
+}
+
+// matchesPort reports whether the pattern covers port
+func (d *destPattern) matchesPort(port int) bool {
+	if len(d.ports) == 0 {
+		return true
+	}
+	for _, pr := range d.ports {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the pattern covers host:port. A CIDR pattern
+// matches an IP literal host, or a name when any of addrs, the addresses
+// it resolved to, is in the range.
+func (d *destPattern) matches(host string, port int, addrs []netip.Addr) bool {
+	if !d.matchesPort(port) {
+		return false
+	}
+	if d.glob != "" {
+		return shExpMatch(strings.ToLower(strings.TrimSuffix(host, ".")), d.glob)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return d.cidr.Contains(addr.Unmap())
+	}
+	for _, addr := range addrs {
+		if d.cidr.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// unresolved reports whether a CIDR pattern cannot be checked against
+// host:port because host is a name that did not resolve (addrs is nil)
+func (d *destPattern) unresolved(host string, port int, addrs []netip.Addr) bool {
+	if d.glob != "" || addrs != nil || !d.matchesPort(port) {
+		return false
+	}
+	_, err := netip.ParseAddr(host)
+	return err != nil
+}
+
+// splitRuleTarget splits host:port for rule matching, reporting false
+// when target has no port
+func splitRuleTarget(target string) (string, int, bool) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, false
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port, true
+}
+
+// hasCIDR reports whether named destinations must be resolved for the policy
+func (p *proxyPolicy) hasCIDR() bool {
+	return p != nil && p.cidr
+}
+
+// check returns a *policyError when target (host:port) is denied, along
+// with the rule that decided (empty when no rule matched). addrs are the
+// addresses target's host resolved to, nil when it did not resolve; a deny
+// rule by CIDR then denies rather than being skipped.
+func (p *proxyPolicy) check(target string, addrs []netip.Addr) (string, error) {
+	host, port, ok := splitRuleTarget(target)
+	if !ok {
+		return "", &policyError{target: target, rule: "invalid destination"}
+	}
+
+	for _, rule := range p.rules {
+		if !rule.allow && rule.unresolved(host, port, addrs) {
+			return rule.text, &policyError{target: target, rule: rule.text, unresolved: true}
+		}
+		if !rule.matches(host, port, addrs) {
+			continue
+		}
+		if !rule.allow {
+			return rule.text, &policyError{target: target, rule: rule.text}
+		}
+		return rule.text, nil
+	}
+	return "", nil
+}
+
+// targetAddrs resolves the host of target (host:port) for CIDR policy and
+// route rules. It returns nil when there are no such rules, the host is an
+// IP literal, or it did not resolve.
+func (p *ProxyServer) targetAddrs(ctx context.Context, target string) []netip.Addr {
+	if !p.policy.hasCIDR() && !p.routes.hasCIDR() {
+		return nil
+	}
+	host, _, ok := splitRuleTarget(target)
+	if !ok {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	if timeout := p.timeouts.forTarget(target).dial; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := p.resolver.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		p.log(LevelDebug, fmt.Sprintf("Could not resolve %s for CIDR rules: %v", host, err))
+		return nil
+	}
+	return addrs
+}
+
+// checkPolicy enforces the destination policy and blocking route rules on
+// target (host:port) and logs the decision
+func (p *ProxyServer) checkPolicy(ctx context.Context, kind, target string) error {
+	addrs := p.targetAddrs(ctx, target)
+	if rule := p.routes.match(target, addrs); rule != nil && rule.route == routeBlock {
+		host, port, _ := splitRuleTarget(target)
+		err := &policyError{target: target, rule: rule.text, unresolved: rule.unresolved(host, port, addrs)}
+		p.log(LevelInfo, fmt.Sprintf("Denied %s %s: %v", kind, target, err))
+		return err
+	}
+	if p.policy == nil {
+		return nil
+	}
+	rule, err := p.policy.check(target, addrs)
+	switch {
+	case err != nil:
+		p.log(LevelInfo, fmt.Sprintf("Denied %s %s: %v", kind, target, err))
+	case rule != "":
+		p.log(LevelDebug, fmt.Sprintf("Allowed %s %s by rule %q", kind, target, rule))
+	default:
+		p.log(LevelDebug, fmt.Sprintf("Allowed %s %s (no rule matched)", kind, target))
+	}
+	return err
+}
+
+// requestTarget returns the host:port a plain-HTTP request is sent to
+func requestTarget(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
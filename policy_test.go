@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestPolicyCIDRMatchesResolvedNames(t *testing.T) {
+	policy, err := newProxyPolicy([]string{"allow *.anthropic.com:443", "deny 203.0.113.0/24", "allow [2001:db8::/32]"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := []netip.Addr{netip.MustParseAddr("198.51.100.7"), netip.MustParseAddr("203.0.113.9")}
+	tests := []struct {
+		target string
+		addrs  []netip.Addr
+		denied bool
+	}{
+		{"203.0.113.9:443", nil, true},
+		{"host-in-range.example:443", blocked, true},
+		{"elsewhere.example:443", []netip.Addr{netip.MustParseAddr("198.51.100.7")}, false},
+		{"unresolvable.example:443", nil, true},
+		{"api.anthropic.com:443", nil, false}, // allowed before the CIDR rule is reached
+		{"v6.example:443", []netip.Addr{netip.MustParseAddr("2001:db8::1")}, false},
+	}
+	for _, tc := range tests {
+		_, err := policy.check(tc.target, tc.addrs)
+		if denied := errors.Is(err, errPolicyDenied); denied != tc.denied {
+			t.Errorf("%s %v: denied = %v, want %v (%v)", tc.target, tc.addrs, denied, tc.denied, err)
+		}
+	}
+}
+
+func TestRouteCIDRMatchesResolvedNames(t *testing.T) {
+	table, err := newRouteTable([]string{"10.0.0.0/8 direct", "192.0.2.0/24 block", "* upstream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		addrs  []netip.Addr
+		route  string
+	}{
+		{"intranet.corp:443", []netip.Addr{netip.MustParseAddr("10.1.2.3")}, routeDirect},
+		{"intranet.corp:443", []netip.Addr{netip.MustParseAddr("192.0.2.1")}, routeBlock},
+		{"unresolvable.corp:443", nil, routeBlock},
+		{"public.example:443", []netip.Addr{netip.MustParseAddr("198.51.100.7")}, routeUpstream},
+	}
+	for _, tc := range tests {
+		rule := table.match(tc.target, tc.addrs)
+		if rule == nil || rule.route != tc.route {
+			t.Errorf("%s %v: got %+v, want route %s", tc.target, tc.addrs, rule, tc.route)
+		}
+	}
+}
+
+func TestRequestDeniedByCIDRForNamedTarget(t *testing.T) {
+	config := loopbackConfig()
+	config.PolicyRules = []string{"deny 203.0.113.0/24"}
+	config.DNSHosts = []string{"203.0.113.5 host-in-range.example"}
+	client := proxyClient(startTestProxy(t, config))
+
+	resp, err := client.Get("http://host-in-range.example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %s, want 403", resp.Status)
+	}
+}
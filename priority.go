@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// maxPriorityDebt bounds how far ahead of the tunnel bandwidth priority
+// flows may run, and so how long they can hold bulk flows back
+const maxPriorityDebt = time.Second
+
+// defaultPriorityHosts get the tunnel first when no priority hosts are configured
+var defaultPriorityHosts = []string{"*.anthropic.com"}
+
+// scheduleWait holds a bulk flow back until its bytes fit the budget (a
+// variable so tests can see which flows wait and for how long)
+var scheduleWait = (*trafficExchange).sleep
+
+// priorityScheduler shares the SSH tunnel's bandwidth between flows. With a
+// tunnel bandwidth configured, every byte relayed to or from the client is
+// charged to a per-direction budget: high-priority flows are never delayed
+// and push bulk flows back, so bulk data does not queue up in the tunnel
+// ahead of API responses.
+type priorityScheduler struct {
+	globs []string
+	up    *rateLimiter // client -> destination
+	down  *rateLimiter // destination -> client
+}
+
+// newPriorityScheduler parses the record's priority host globs. Without a
+// tunnel bandwidth there is nothing to share, so it returns nil and no flow
+// is treated differently.
+func newPriorityScheduler(settings ProxySettings) *priorityScheduler {
+	if settings.TunnelBandwidth <= 0 {
+		return nil
+	}
+	s := &priorityScheduler{}
+	for _, line := range settings.PriorityHosts {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if glob := strings.ToLower(strings.TrimSpace(line)); glob != "" {
+			s.globs = append(s.globs, glob)
+		}
+	}
+	if len(s.globs) == 0 {
+		s.globs = defaultPriorityHosts
+	}
+
+	// Up to a quarter second of traffic may be sent at once
+	rate := float64(settings.TunnelBandwidth) * 1024
+	s.up = newRateLimiter(rate, rate/4)
+	s.down = newRateLimiter(rate, rate/4)
+	return s
+}
+
+// isPriority reports whether a destination host gets the tunnel first
+func (s *priorityScheduler) isPriority(host string) bool {
+	if s == nil {
+		return false
+	}
+	for _, glob := range s.globs {
+		if shExpMatch(host, glob) {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule charges n bytes of an exchange to one direction of the tunnel and
+// delays bulk flows until the budget allows them. Priority flows never wait;
+// their debt is capped at maxPriorityDebt so bulk flows are not starved.
+func (ex *trafficExchange) schedule(up bool, n int) {
+	if ex.scheduler == nil {
+		return
+	}
+	budget := ex.scheduler.down
+	if up {
+		budget = ex.scheduler.up
+	}
+	if ex.priority {
+		budget.charge(float64(n), maxPriorityDebt)
+		return
+	}
+	scheduleWait(ex, budget.reserve(float64(n)))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorityDebtIsCapped(t *testing.T) {
+	limiter := newRateLimiter(1000, 250)
+	limiter.charge(1e6, maxPriorityDebt)
+	if wait := limiter.reserve(1); wait > maxPriorityDebt+50*time.Millisecond {
+		t.Fatalf("bulk flow waits %s after a large priority burst, want at most about %s", wait, maxPriorityDebt)
+	}
+}
+
+func TestPrioritySchedulerOffWithoutBandwidth(t *testing.T) {
+	if s := newPriorityScheduler(ProxySettings{PriorityHosts: []string{"*.anthropic.com"}}); s != nil {
+		t.Fatal("scheduler enabled without a tunnel bandwidth")
+	}
+}
+
+// TestPriorityFlowsAreLetThroughFirst replays a bulk download competing with
+// an API response for a saturated tunnel and checks which flow is held back
+func TestPriorityFlowsAreLetThroughFirst(t *testing.T) {
+	type grant struct {
+		flow string
+		wait time.Duration
+	}
+	var grants []grant
+	saved := scheduleWait
+	scheduleWait = func(ex *trafficExchange, wait time.Duration) {
+		grants = append(grants, grant{ex.host, wait})
+	}
+	t.Cleanup(func() { scheduleWait = saved })
+
+	s := newPriorityScheduler(ProxySettings{TunnelBandwidth: 1, PriorityHosts: []string{"api.priority.test"}}) // 1 KB/s
+	flow := func(host string) *trafficExchange {
+		return &trafficExchange{host: host, priority: s.isPriority(host), scheduler: s, done: make(chan struct{})}
+	}
+	bulk, api := flow("bulk.test"), flow("api.priority.test")
+	if bulk.priority || !api.priority {
+		t.Fatalf("priority: bulk %v, api %v", bulk.priority, api.priority)
+	}
+
+	bulk.schedule(false, 1024) // spends the burst and more
+	api.schedule(false, 32<<10)
+	bulk.schedule(false, 1)
+	bulk.schedule(true, 1) // the other direction has its own budget
+
+	if len(grants) != 3 {
+		t.Fatalf("got grants %v, want three for the bulk flow and none for the API flow", grants)
+	}
+	for _, g := range grants {
+		if g.flow != "bulk.test" {
+			t.Fatalf("API flow was held back: %v", grants)
+		}
+	}
+	if grants[0].wait <= 0 {
+		t.Errorf("bulk flow past the burst was let through at once")
+	}
+	// The API response pushes bulk data back by at most maxPriorityDebt
+	if wait := grants[1].wait; wait < maxPriorityDebt-100*time.Millisecond || wait > maxPriorityDebt+100*time.Millisecond {
+		t.Errorf("bulk flow after the API response waits %s, want about %s", wait, maxPriorityDebt)
+	}
+	if grants[2].wait != 0 {
+		t.Errorf("upload waits %s behind the download budget", grants[2].wait)
+	}
+}
@@ -1,59 +1,200 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
-// ProxyServer handles HTTP CONNECT proxy requests
+// ProxyServer handles HTTP CONNECT and SOCKS5 proxy requests on one port
 type ProxyServer struct {
 	port        int
 	server      *http.Server
 	listener    net.Listener
+	httpConns   *connQueue
 	mu          sync.Mutex
 	httpProxy   string
 	httpsProxy  string
+	settings    ProxySettings
+	users       map[string]string
+	authStates  sync.Map // upstream proxy -> *upstreamAuthState
+	upstreamTLS *tls.Config
+	pac         *pacResolver
+	policy      *proxyPolicy
+	routes      *routeTable
+	guard       *ssrfGuard
+	resolver    *dnsResolver
+	egress      *egressBinding
+	upstreams   *upstreamPool // failover list replacing httpProxy / httpsProxy
+	envProxy    *envProxy     // HTTP_PROXY / HTTPS_PROXY / NO_PROXY of A
+	reverse     *reverseProxy // Anthropic API endpoint for ANTHROPIC_BASE_URL
+	timeouts    *timeoutPolicy
+	limits      *proxyLimits
+	scheduler   *priorityScheduler
+	viaToken    string                       // our pseudonym in Via headers
+	directHTTP  *http.Transport              // plain-HTTP requests without an upstream proxy
+	transports  map[string]http.RoundTripper // upstream proxy URL -> shared transport
 	proxyDialer *net.Dialer
+	traffic     *TrafficStats
+	record      string         // record label for traffic statistics
+	conns       *connRegistry  // exchanges in progress
+	origins     *clientOrigins // B client addresses of tunnelled connections
 	log         LogFunc
 }
 
 // NewProxyServer creates a new proxy server instance
-func NewProxyServer(port int, httpProxy, httpsProxy string, log LogFunc) *ProxyServer {
+func NewProxyServer(config *Config, traffic *TrafficStats, log LogFunc) *ProxyServer {
 	return &ProxyServer{
-		port:        port,
-		httpProxy:   httpProxy,
-		httpsProxy:  httpsProxy,
+		port:        config.ProxyPort,
+		httpProxy:   config.HTTPProxy,
+		httpsProxy:  config.HTTPSProxy,
+		settings:    config.ProxySettings,
+		users:       parseProxyUsers(config.ProxyUsers),
+		viaToken:    newViaToken(),
 		proxyDialer: &net.Dialer{Timeout: 30 * time.Second},
+		traffic:     traffic,
+		record:      config.recordLabel(),
+		conns:       newConnRegistry(),
 		log:         log,
 	}
 }
 
-// Start starts the proxy server
+// Start starts the proxy server. Each accepted connection is sniffed and
+// served either as SOCKS5 or handed over to the HTTP server.
 func (p *ProxyServer) Start() error {
 	addr := fmt.Sprintf("127.0.0.1:%d", p.port)
 
+	upstreamTLS, err := loadUpstreamTLS(p.settings)
+	if err != nil {
+		return err
+	}
+
+	policy, err := newProxyPolicy(p.settings.PolicyRules, p.settings.PolicyPreset)
+	if err != nil {
+		return err
+	}
+
+	routes, err := newRouteTable(p.settings.RouteRules)
+	if err != nil {
+		return err
+	}
+
+	guard, err := newSSRFGuard(p.settings.AllowPrivateNetworks)
+	if err != nil {
+		return err
+	}
+
+	timeouts, err := newTimeoutPolicy(p.settings)
+	if err != nil {
+		return err
+	}
+
+	egress, err := newEgressBinding(p.settings)
+	if err != nil {
+		return err
+	}
+	if egress != nil {
+		p.log(LevelInfo, fmt.Sprintf("Binding outbound connections to %s", egress))
+	}
+
+	resolver, err := newDNSResolver(p.settings, egress, p.log)
+	if err != nil {
+		return err
+	}
+	if resolver.network != "" {
+		p.log(LevelInfo, fmt.Sprintf("Using DNS server: %s", resolver.describe()))
+	}
+
+	upstreams, err := newUpstreamPool(p.settings)
+	if err != nil {
+		return err
+	}
+
+	reverse, err := newReverseProxy(p.settings)
+	if err != nil {
+		return err
+	}
+
+	var pac *pacResolver
+	if p.settings.PACURL != "" {
+		if pac, err = loadPAC(p.settings.PACURL, egress, resolver); err != nil {
+			return err
+		}
+		p.log(LevelInfo, fmt.Sprintf("Using PAC script: %s", p.settings.PACURL))
+	}
+
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
 	p.mu.Lock()
+	p.upstreamTLS = upstreamTLS
+	p.pac = pac
+	p.policy = policy
+	p.routes = routes
+	p.guard = guard
+	p.resolver = resolver
+	p.egress = egress
+	p.upstreams = upstreams
+	p.reverse = reverse
+	if p.settings.UseEnvironmentProxy {
+		p.envProxy = newEnvProxy()
+	}
+	p.timeouts = timeouts
+	p.limits = newProxyLimits(p.settings)
+	p.scheduler = newPriorityScheduler(p.settings)
+	if p.scheduler == nil && len(p.settings.PriorityHosts) > 0 {
+		p.log(LevelInfo, "Priority hosts are ignored until a tunnel bandwidth is set")
+	}
+	p.proxyDialer = egress.apply(&net.Dialer{Timeout: timeouts.base.dial}, "tcp")
+	p.directHTTP = p.newDirectTransport()
+	p.transports = make(map[string]http.RoundTripper)
 	p.listener = listener
+	p.httpConns = newConnQueue(listener.Addr())
 	p.server = &http.Server{
-		Handler:      http.HandlerFunc(p.handleRequest),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 0, // No write timeout for streaming
-		IdleTimeout:  120 * time.Second,
+		Handler: http.HandlerFunc(p.handleRequest),
+		// Only the request head is bounded: a ReadTimeout would also cut
+		// hijacked tunnels and streamed uploads, which use the idle timeout
+		ReadHeaderTimeout: 30 * time.Second,
+		WriteTimeout:      0, // No write timeout for streaming
+		IdleTimeout:       120 * time.Second,
 	}
 	p.mu.Unlock()
 
-	p.log(LevelInfo, fmt.Sprintf("Listening on %s", addr))
-	return p.server.Serve(listener)
+	go p.server.Serve(p.httpConns)
+	if p.envProxy != nil {
+		p.logEnvProxy()
+	}
+	if upstreams != nil {
+		go p.checkUpstreams(upstreams)
+	}
+
+	p.log(LevelInfo, fmt.Sprintf("Listening on %s (HTTP/SOCKS5)", addr))
+	if reverse != nil {
+		p.log(LevelInfo, fmt.Sprintf("Forwarding http://%s%s/ to %s", addr, reverse.prefix, anthropicAPIOrigin))
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go p.dispatch(conn)
+	}
 }
 
 // Stop stops the proxy server
@@ -61,55 +202,127 @@ func (p *ProxyServer) Stop() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if p.listener != nil {
+		p.listener.Close()
+	}
 	if p.server != nil {
 		p.server.Close()
 	}
+	if p.upstreams != nil {
+		p.upstreams.close()
+	}
+	// http.Server.Close does not track hijacked or SOCKS5 connections
+	p.CloseAllConnections()
+	p.closeTransports()
+}
+
+// dispatch peeks at the first byte of conn to tell SOCKS5 from HTTP
+func (p *ProxyServer) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	sniffed := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := sniffed.r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if first[0] == socks5Version {
+		p.handleSOCKS5(sniffed)
+		return
+	}
+	if !p.httpConns.push(sniffed) {
+		conn.Close()
+	}
 }
 
 // handleRequest handles incoming proxy requests
 func (p *ProxyServer) handleRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodConnect {
+	// Reverse-proxy clients are API SDKs, which do not answer a 407, so
+	// they authenticate with an ordinary header and get a 401
+	reverse := r.Method != http.MethodConnect && p.reverse.matches(r)
+	authHeader := "Proxy-Authorization"
+	if reverse {
+		authHeader = reverseAuthHeader
+	}
+	user, ok := p.authenticateRequest(r, authHeader)
+	if !ok {
+		if reverse {
+			rejectReverseAuth(w)
+		} else {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="claude-proxy"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		}
+		p.log(LevelDebug, fmt.Sprintf("Proxy authentication required for %s %s from %s", r.Method, r.Host, r.RemoteAddr))
+		return
+	}
+	if user != "" {
+		r = r.WithContext(context.WithValue(r.Context(), proxyUserKey{}, user))
+	}
+
+	// Our own Via token means an upstream sent the request back to us
+	if p.isLoop(r.Header) {
+		http.Error(w, "Proxy loop detected", http.StatusLoopDetected)
+		p.log(LevelError, fmt.Sprintf("Proxy loop detected for %s %s, check the upstream proxy settings", r.Method, r.Host))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodConnect:
 		p.handleConnect(w, r)
-	} else {
-		p.handleHTTP(w, r)
+	case reverse:
+		p.handleReverse(w, r)
+	default:
+		p.handleHTTP(w, r, "HTTP")
 	}
 }
 
 // handleConnect handles HTTPS CONNECT tunnel requests
 func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
-	p.log(LevelDebug, fmt.Sprintf(">> 收到 HTTPS 请求: %s", r.Host))
+	p.log(LevelDebug, fmt.Sprintf(">> 收到 HTTPS 请求: %s%s", r.Host, userSuffix(requestUser(r))))
 
-	var targetConn net.Conn
-	var err error
+	ex := p.beginExchange("CONNECT", r.Host, r.RemoteAddr, requestUser(r))
+	defer p.finishExchange(ex)
 
-	// Check if we need to use upstream proxy for HTTPS
-	if p.httpsProxy != "" {
-		targetConn, err = p.dialThroughProxy(p.httpsProxy, r.Host)
-	} else {
-		// Direct connection
-		targetConn, err = net.DialTimeout("tcp", r.Host, 30*time.Second)
+	// Until the tunnel is up, killing the exchange aborts the policy
+	// lookup, the limit queue and the dial
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	ex.setCloser(connConnecting, func() { cancel(errConnectionKilled) })
+
+	if err := p.checkPolicy(ctx, "CONNECT", r.Host); err != nil {
+		ex.result = trafficDenied
+		http.Error(w, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+		return
 	}
 
+	release, err := p.admit(ctx, ex)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to %s: %v", r.Host, err), http.StatusBadGateway)
-		p.log(LevelError, fmt.Sprintf("Failed to connect to %s: %v", r.Host, err))
+		p.rejectLimited(w, ex, err)
 		return
 	}
-	defer targetConn.Close()
+	defer release()
 
-	// Hijack the client connection
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+	targetConn, err := p.dialTarget(ctx, r.Host)
+	if err != nil {
+		ex.result = dialResult(err)
+		http.Error(w, fmt.Sprintf("Failed to connect to %s: %v", r.Host, err), dialErrorStatus(err))
+		p.log(LevelError, fmt.Sprintf("Failed to connect to %s: %v", r.Host, err))
 		return
 	}
+	defer targetConn.Close()
 
-	clientConn, _, err := hijacker.Hijack()
+	// Hijack the client connection
+	clientConn, err := hijack(w)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Hijack failed: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
+	ex.setCloser(connOpen, func() {
+		clientConn.Close()
+		targetConn.Close()
+	})
 
 	// Send 200 Connection Established
 	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
@@ -118,7 +331,99 @@ func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Bidirectional copy
+	ex.result = trafficOK
+	p.relay(&countingConn{ReadWriteCloser: clientConn, ex: ex}, targetConn, p.timeouts.forTarget(r.Host))
+	p.log(LevelDebug, fmt.Sprintf("CONNECT %s completed", r.Host))
+}
+
+// dialTarget opens a TCP connection to target along its route, going
+// through the HTTPS upstream proxy unless a route rule says otherwise
+func (p *ProxyServer) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	if err := p.guard.checkTarget(target); err != nil {
+		return nil, err
+	}
+	upstreams, err := p.routeFor(ctx, &url.URL{Scheme: "https", Host: target}, p.httpsProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for i, upstream := range upstreams {
+		var conn net.Conn
+		var err error
+		if upstream == "" {
+			conn, err = p.dialDirect(ctx, target)
+		} else {
+			conn, err = p.dialThroughProxy(ctx, upstream, target)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(upstreams)-1 {
+			p.log(LevelDebug, fmt.Sprintf("Route %s to %s failed, trying next: %v", routeName(upstream), target, err))
+		}
+	}
+	return nil, lastErr
+}
+
+// upstreamsFor returns the upstream proxies to try for a destination, in
+// order; an empty string means a direct connection. The PAC script decides
+// when configured, then the failover list, then A's environment variables,
+// otherwise the static proxy setting does.
+func (p *ProxyServer) upstreamsFor(target *url.URL, static string) []string {
+	if p.pac != nil {
+		upstreams, err := p.pac.find(target)
+		if err == nil {
+			p.log(LevelDebug, fmt.Sprintf("PAC %s -> %s", target.Hostname(), routeNames(upstreams)))
+			return upstreams
+		}
+		p.log(LevelError, fmt.Sprintf("PAC lookup for %s failed, using static settings: %v", target.Hostname(), err))
+	}
+	if p.upstreams != nil {
+		return p.upstreams.order()
+	}
+	if p.envProxy != nil {
+		upstream, err := p.envProxy.upstream(target)
+		if err == nil {
+			return []string{upstream}
+		}
+		p.log(LevelError, fmt.Sprintf("Environment proxy for %s failed, using static settings: %v", target.Hostname(), err))
+	}
+	return []string{static}
+}
+
+// routeName describes an upstream for logs without its credentials
+func routeName(upstream string) string {
+	if upstream == "" {
+		return "DIRECT"
+	}
+	if parsed, err := parseUpstreamProxy(upstream); err == nil {
+		return parsed.String()
+	}
+	return upstream
+}
+
+// relay copies data between the client and the target until both directions are done
+func (p *ProxyServer) relay(clientConn, targetConn io.ReadWriteCloser, timeouts timeoutSettings) {
+	defer lifetimeTimer(timeouts.lifetime, clientConn, targetConn)()
+
+	// A tunnel is idle only when neither side sends anything, so a
+	// long server-sent stream is not cut because the client is quiet
+	client, target := clientConn, targetConn
+	idle := newIdleTimer(timeouts.tunnel, func() {
+		client.Close()
+		target.Close()
+	})
+	defer idle.stop()
+	if idle != nil {
+		clientConn = &activityConn{ReadWriteCloser: clientConn, timer: idle}
+		targetConn = &activityConn{ReadWriteCloser: targetConn, timer: idle}
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -126,92 +431,367 @@ func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer wg.Done()
 		io.Copy(targetConn, clientConn)
-		targetConn.(*net.TCPConn).CloseWrite()
+		closeWrite(targetConn)
 	}()
 
 	// Target -> Client
 	go func() {
 		defer wg.Done()
 		io.Copy(clientConn, targetConn)
-		clientConn.(*net.TCPConn).CloseWrite()
+		closeWrite(clientConn)
 	}()
 
 	wg.Wait()
-	p.log(LevelDebug, fmt.Sprintf("CONNECT %s completed", r.Host))
 }
 
-// dialThroughProxy connects to target through an HTTP proxy
-func (p *ProxyServer) dialThroughProxy(proxyURL, targetHost string) (net.Conn, error) {
-	parsedURL, err := url.Parse(proxyURL)
+// dialThroughProxy connects to target through an upstream HTTP(S), SOCKS5 or
+// SOCKS4a proxy. Cancelling ctx aborts the dial and the handshake.
+func (p *ProxyServer) dialThroughProxy(ctx context.Context, proxyURL, targetHost string) (net.Conn, error) {
+	upstream, err := parseUpstreamProxy(proxyURL)
 	if err != nil {
-		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		return nil, err
 	}
 
-	// Connect to the proxy server
-	proxyAddr := parsedURL.Host
-	if parsedURL.Port() == "" {
-		proxyAddr = net.JoinHostPort(parsedURL.Hostname(), "80")
+	if err := p.checkUpstreamTarget(ctx, upstream, targetHost); err != nil {
+		return nil, newUpstreamError(upstream, targetHost, err)
 	}
 
-	conn, err := p.proxyDialer.Dial("tcp", proxyAddr)
+	// Bound the whole handshake; the tunnel itself has no deadline
+	deadline := time.Now().Add(upstreamHandshakeTimeout)
+	conn, err := p.dialUpstream(ctx, upstream, deadline)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyAddr, err)
+		return nil, err
 	}
 
-	// Send CONNECT request to proxy
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetHost, targetHost)
-	_, err = conn.Write([]byte(connectReq))
+	switch upstream.scheme {
+	case "socks5", "socks5h":
+		stop := abortOnCancel(ctx, conn)
+		err = p.socks5Connect(ctx, conn, upstream, targetHost)
+		stop()
+	case "socks4a":
+		stop := abortOnCancel(ctx, conn)
+		err = socks4aConnect(conn, upstream, targetHost)
+		stop()
+	default:
+		conn, err = p.httpConnect(ctx, conn, upstream, targetHost, deadline)
+	}
+	if err == nil && ctx.Err() != nil {
+		// Cancelled just as the handshake finished
+		err = ctx.Err()
+	}
 	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, newUpstreamError(upstream, targetHost, err)
 	}
+	conn.SetDeadline(time.Time{})
 
-	// Read proxy response
-	response := make([]byte, 4096)
-	n, err := conn.Read(response)
+	p.log(LevelDebug, fmt.Sprintf("Connected to %s through proxy %s", targetHost, upstream))
+	return conn, nil
+}
+
+// dialUpstream opens a connection to the proxy server itself, wrapped in
+// TLS for https:// proxies. The connection keeps the given deadline.
+func (p *ProxyServer) dialUpstream(ctx context.Context, upstream *upstreamProxy, deadline time.Time) (net.Conn, error) {
+	conn, err := p.proxyDialer.DialContext(ctx, "tcp", upstream.addr)
 	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to read proxy response: %w", err)
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", upstream.addr, err)
 	}
+	conn.SetDeadline(deadline)
 
-	// Check if proxy accepted the connection (200 or 201)
-	responseStr := string(response[:n])
-	if !contains(responseStr, "200") && !contains(responseStr, "201") {
+	if upstream.scheme != "https" {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, p.upstreamTLSConfig(upstream))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("proxy rejected connection: %s", responseStr[:min(200, n)])
+		return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", upstream.addr, err)
 	}
+	return tlsConn, nil
+}
 
-	p.log(LevelDebug, fmt.Sprintf("Connected to %s through proxy %s", targetHost, proxyAddr))
-	return conn, nil
+// abortOnCancel makes blocked reads and writes on conn fail once ctx is
+// cancelled. The returned stop must be called before conn is handed on.
+func abortOnCancel(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to targetHost, answering
+// Basic, Digest and NTLM challenges. The proxy may close the connection
+// after a 407, so the returned conn is the one currently in use (possibly
+// nil) and must be closed by the caller on error.
+func (p *ProxyServer) httpConnect(ctx context.Context, conn net.Conn, upstream *upstreamProxy, targetHost string, deadline time.Time) (net.Conn, error) {
+	stop := abortOnCancel(ctx, conn)
+	defer func() { stop() }()
+
+	handshake := newProxyAuthHandshake(upstream, p.authState(upstream))
+	auth, err := handshake.initial(http.MethodConnect, targetHost)
+	if err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	for attempt := 0; ; attempt++ {
+		// Send CONNECT request to proxy
+		connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", targetHost, targetHost)
+		if auth != "" {
+			connectReq += "Proxy-Authorization: " + auth + "\r\n"
+		}
+		// The hop-by-hop marker lets isLoop catch an upstream that routes the tunnel back to us
+		connectReq += loopHeader + ": " + p.viaToken + "\r\nConnection: " + loopHeader + "\r\n"
+		if p.settings.AddViaHeader {
+			connectReq += "Via: " + p.viaValue(1, 1) + "\r\n"
+		}
+		connectReq += "Proxy-Connection: Keep-Alive\r\n\r\n"
+		if _, err := conn.Write([]byte(connectReq)); err != nil {
+			return conn, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+		}
+
+		// Read the status line and headers; anything after them already
+		// belongs to the tunnel
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return conn, fmt.Errorf("failed to read proxy response: %w", err)
+		}
+		p.log(LevelDebug, fmt.Sprintf("Upstream proxy %s answered %q to CONNECT %s", upstream, resp.Status, targetHost))
+
+		if resp.ProtoMajor != 1 {
+			resp.Body.Close()
+			return conn, fmt.Errorf("unexpected protocol %s in proxy response", resp.Proto)
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if br.Buffered() > 0 {
+				return &bufferedConn{Conn: conn, r: br}, nil
+			}
+			return conn, nil
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired || attempt >= 3 {
+			resp.Body.Close()
+			return conn, &upstreamStatusError{status: resp.StatusCode, reason: resp.Status}
+		}
+
+		auth, err = handshake.respond(resp, http.MethodConnect, targetHost)
+		if err != nil {
+			resp.Body.Close()
+			return conn, &upstreamStatusError{status: resp.StatusCode, reason: resp.Status, detail: err.Error()}
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+
+		if resp.Close {
+			stop()
+			conn.Close()
+			conn, err = p.dialUpstream(ctx, upstream, deadline)
+			if err != nil {
+				return nil, err
+			}
+			stop = abortOnCancel(ctx, conn)
+			br = bufio.NewReader(conn)
+		}
+	}
 }
 
-// Helper function to check if string contains substring
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s[:len(substr)] == substr || len(s) > len(substr) && s[1:len(substr)+1] == substr || stringContains(s, substr))
+// dialErrorStatus picks the status code reported to the client when the
+// target (or the upstream proxy in front of it) cannot be reached
+func dialErrorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errUpstreamForbidden), errors.Is(err, errPrivateNetwork):
+		return http.StatusForbidden
+	case errors.Is(err, errUpstreamTimeout), errors.Is(err, errResponseHeaderTimeout), errors.Is(err, errLifetimeExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
 }
 
-func stringContains(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+// dialResult classifies a failed dial for traffic statistics: destinations
+// refused by an upstream proxy or the private-network guard count as denied
+func dialResult(err error) string {
+	if errors.Is(err, errUpstreamForbidden) || errors.Is(err, errPrivateNetwork) {
+		return trafficDenied
+	}
+	return trafficError
+}
+
+// parseProxyUsers turns "user:password" entries into a lookup map
+func parseProxyUsers(entries []string) map[string]string {
+	users := make(map[string]string)
+	for _, entry := range entries {
+		user, password, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || user == "" {
+			continue
 		}
+		users[user] = password
 	}
-	return false
+	return users
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// checkProxyUser reports whether user/password matches a configured proxy user
+func (p *ProxyServer) checkProxyUser(user, password string) bool {
+	expected, ok := p.users[user]
+	if !ok {
+		return false
 	}
-	return b
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
 }
 
-// handleHTTP handles regular HTTP requests (non-CONNECT)
-func (p *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	p.log(LevelDebug, fmt.Sprintf(">> 收到 HTTP 请求: %s %s", r.Method, r.URL.String()))
+// proxyUserKey carries the authenticated client user in the request context
+type proxyUserKey struct{}
+
+// authenticateRequest checks the Basic credentials in the given header
+// (Proxy-Authorization for proxy requests) when users are configured and
+// returns the authenticated user
+func (p *ProxyServer) authenticateRequest(r *http.Request, header string) (string, bool) {
+	if len(p.users) == 0 {
+		return "", true
+	}
+	scheme, credentials, _ := strings.Cut(r.Header.Get(header), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", false
+	}
+	user, password, _ := strings.Cut(string(decoded), ":")
+	if !p.checkProxyUser(user, password) {
+		p.log(LevelInfo, fmt.Sprintf("Proxy authentication failed for user %q from %s", user, r.RemoteAddr))
+		return "", false
+	}
+	return user, true
+}
+
+// requestUser returns the authenticated client user of a request, if any
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(proxyUserKey{}).(string)
+	return user
+}
+
+// userSuffix formats the client user for request logs
+func userSuffix(user string) string {
+	if user == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (用户 %s)", user)
+}
+
+// closeWrite half-closes conn when the underlying connection supports it
+func closeWrite(conn io.Writer) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// bufferedConn replays bytes that were read ahead into r (while sniffing
+// the protocol or parsing an upstream handshake) before reading from Conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// connQueue is a net.Listener fed with connections that ProxyServer.Start
+// already accepted and identified as HTTP
+type connQueue struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push hands conn to the HTTP server, returning false once the queue is closed
+func (q *connQueue) push(conn net.Conn) bool {
+	select {
+	case q.conns <- conn:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *connQueue) Close() error {
+	q.once.Do(func() { close(q.done) })
+	return nil
+}
+
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
+
+// handleHTTP handles regular HTTP requests (non-CONNECT) and, as kind
+// "API", requests rewritten by the Anthropic API reverse proxy
+func (p *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request, kind string) {
+	p.log(LevelDebug, fmt.Sprintf(">> 收到 %s 请求: %s %s%s", kind, r.Method, r.URL.String(), userSuffix(requestUser(r))))
+
+	ex := p.beginExchange(kind, r.URL.Host, r.RemoteAddr, requestUser(r))
+	defer p.finishExchange(ex)
+
+	if err := p.checkPolicy(r.Context(), kind, requestTarget(r.URL)); err != nil {
+		ex.result = trafficDenied
+		http.Error(w, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+		return
+	}
+	if err := p.guard.checkTarget(requestTarget(r.URL)); err != nil {
+		ex.result = trafficDenied
+		http.Error(w, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+		p.log(LevelInfo, fmt.Sprintf("Denied %s %s: %v", kind, r.URL.Host, err))
+		return
+	}
+
+	release, err := p.admit(r.Context(), ex)
+	if err != nil {
+		p.rejectLimited(w, ex, err)
+		return
+	}
+	defer release()
+
+	// The request is cancelled when the client goes away or a timeout fires
+	timeouts := p.timeouts.forHost(r.URL.Hostname())
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	ex.setCloser(connConnecting, func() { cancel(errConnectionKilled) })
+	if timeouts.lifetime > 0 {
+		lifetime := time.AfterFunc(timeouts.lifetime, func() { cancel(errLifetimeExceeded) })
+		defer lifetime.Stop()
+	}
 
 	// Create the outgoing request
-	outReq, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+	body := r.Body
+	if body != nil && body != http.NoBody {
+		body = &countingBody{ReadCloser: body, ex: ex, up: true}
+	}
+	outReq, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), body)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
 		return
@@ -224,38 +804,82 @@ func (p *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Remove hop-by-hop headers
-	outReq.Header.Del("Proxy-Connection")
-	outReq.Header.Del("Proxy-Authenticate")
-	outReq.Header.Del("Proxy-Authorization")
+	// Remove hop-by-hop headers; an upgrade (e.g. WebSocket) keeps the
+	// headers that ask the origin to switch protocols
+	upgrade := upgradeType(r.Header)
+	removeHopHeaders(outReq.Header)
+	if upgrade != "" {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", upgrade)
+	}
+	if p.settings.AddViaHeader {
+		outReq.Header.Add("Via", p.viaValue(r.ProtoMajor, r.ProtoMinor))
+	}
+	if p.settings.AddForwardedFor {
+		p.addForwardedFor(outReq.Header, r)
+	}
 
-	// Create HTTP client with optional proxy
-	client := &http.Client{
-		Timeout: 120 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse // Don't follow redirects
-		},
+	// Try each upstream in turn. A request whose body has already been
+	// sent cannot be replayed, so it only gets one attempt.
+	replayable := outReq.Body == nil || outReq.Body == http.NoBody || outReq.GetBody != nil
+	static := p.httpProxy
+	if r.URL.Scheme == "https" {
+		static = p.httpsProxy
+	}
+	upstreams, err := p.routeFor(ctx, r.URL, static)
+	if err != nil {
+		ex.result = trafficDenied
+		http.Error(w, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+		return
 	}
 
-	// Configure upstream proxy if specified
-	if p.httpProxy != "" {
-		proxyURL, err := url.Parse(p.httpProxy)
-		if err == nil {
-			client.Transport = &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
+	var resp *http.Response
+	for i, upstream := range upstreams {
+		req := outReq
+		if i > 0 {
+			if req, err = rewindRequest(outReq); err != nil {
+				break
+			}
+		}
+		if upstream != "" {
+			if err = p.checkUpstreamRoute(ctx, upstream, requestTarget(r.URL)); err != nil {
+				break
 			}
-			p.log(LevelDebug, fmt.Sprintf("Using upstream HTTP proxy: %s", p.httpProxy))
+		}
+		resp, err = p.sendHTTP(p.markForUpstream(req, upstream), upstream, timeouts.header, cancel)
+		if err == nil || !replayable || ctx.Err() != nil {
+			break
+		}
+		if i < len(upstreams)-1 {
+			p.log(LevelDebug, fmt.Sprintf("Route %s to %s failed, trying next: %v", routeName(upstream), r.URL.Host, err))
 		}
 	}
-
-	resp, err := client.Do(outReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send request: %v", err), http.StatusBadGateway)
+		if cause := context.Cause(ctx); cause != nil && cause != context.Canceled {
+			err = cause
+		}
+		ex.result = dialResult(err)
+		http.Error(w, fmt.Sprintf("Failed to send request: %v", err), dialErrorStatus(err))
+		p.log(LevelError, fmt.Sprintf("Failed to send request to %s: %v", r.URL.Host, err))
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		p.handleUpgradeResponse(w, r, resp, upgrade, timeouts, ex)
 		return
 	}
+	ex.result = trafficOK
+	ex.setState(connOpen)
+	resp.Body = &countingBody{ReadCloser: resp.Body, ex: ex}
+	if idle := newIdleTimer(timeouts.idle, func() { cancel(errStreamIdle) }); idle != nil {
+		resp.Body = &activityBody{ReadCloser: resp.Body, timer: idle}
+	}
 	defer resp.Body.Close()
 
 	// Copy response headers
+	removeHopHeaders(resp.Header)
+	if p.settings.AddViaHeader {
+		resp.Header.Add("Via", p.viaValue(resp.ProtoMajor, resp.ProtoMinor))
+	}
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
@@ -281,4 +905,34 @@ func (p *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		io.Copy(w, resp.Body)
 	}
+
+	if cause := context.Cause(ctx); cause == errStreamIdle || cause == errLifetimeExceeded || cause == errConnectionKilled {
+		p.log(LevelInfo, fmt.Sprintf("%s %s closed: %v", kind, r.URL.Host, cause))
+	}
+}
+
+// sendHTTP forwards a plain-HTTP request directly or through one upstream
+// proxy. cancel aborts the request when no response headers arrive in time;
+// the body is bounded by the caller's idle and lifetime timeouts instead.
+func (p *ProxyServer) sendHTTP(req *http.Request, upstream string, header time.Duration, cancel context.CancelCauseFunc) (*http.Response, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // Don't follow redirects
+		},
+	}
+
+	transport, err := p.transportFor(upstream)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = transport
+	if upstream != "" {
+		p.log(LevelDebug, fmt.Sprintf("Using upstream HTTP proxy: %s", routeName(upstream)))
+	}
+
+	if header > 0 {
+		timer := time.AfterFunc(header, func() { cancel(errResponseHeaderTimeout) })
+		defer timer.Stop()
+	}
+	return client.Do(req)
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startTestProxy runs a ProxyServer for config on a free loopback port and
+// returns it once it accepts connections
+func startTestProxy(t *testing.T, config *Config) *ProxyServer {
+	t.Helper()
+	p := NewProxyServer(config, NewTrafficStats(), func(level, msg string) { t.Logf("%s %s", level, msg) })
+	errc := make(chan error, 1)
+	go func() { errc <- p.Start() }()
+	t.Cleanup(p.Stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-errc:
+			t.Fatalf("proxy did not start: %v", err)
+		default:
+		}
+		p.mu.Lock()
+		started := p.listener != nil
+		p.mu.Unlock()
+		if started {
+			return p
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("proxy did not start in time")
+	return nil
+}
+
+// proxyURL is the address HTTP clients use to reach p
+func (p *ProxyServer) proxyURL() *url.URL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &url.URL{Scheme: "http", Host: p.listener.Addr().String()}
+}
+
+// proxyClient returns an HTTP client sending its requests through p
+func proxyClient(p *ProxyServer) *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(p.proxyURL())}}
+}
+
+// loopbackConfig allows the proxy to reach test servers on 127.0.0.1
+func loopbackConfig() *Config {
+	return &Config{ProxySettings: ProxySettings{AllowPrivateNetworks: []string{"127.0.0.0/8"}}}
+}
+
+// newOrigin starts an origin server answering "hello <path>"
+func newOrigin(t *testing.T) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
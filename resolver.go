@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsTimeout bounds one query to the configured DNS server
+	dnsTimeout = 5 * time.Second
+	// systemDNSTTL is how long system resolver answers are cached; the
+	// system resolver does not report TTLs
+	systemDNSTTL = 30 * time.Second
+	// maxDNSTTL caps the TTL of cached answers
+	maxDNSTTL = time.Hour
+	// maxDNSCacheEntries bounds the number of cached names
+	maxDNSCacheEntries = 1024
+)
+
+// dnsResolver resolves destination names for direct connections: static
+// host overrides first, then the in-memory cache, then the system resolver
+// or the configured UDP, TCP or DNS-over-HTTPS server
+type dnsResolver struct {
+	server  string // "" for the system resolver
+	network string // udp, tcp or https
+	hosts   map[string][]netip.Addr
+	doh     *http.Client
+	egress  *egressBinding
+	log     LogFunc
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// newDNSResolver parses the record's DNS server and host overrides. The
+// server is an address (UDP), tcp://address, udp://address or an https://
+// DNS-over-HTTPS URL; empty or "system" uses the system resolver.
+func newDNSResolver(settings ProxySettings, egress *egressBinding, log LogFunc) (*dnsResolver, error) {
+	r := &dnsResolver{
+		hosts:  make(map[string][]netip.Addr),
+		egress: egress,
+		log:    log,
+		cache:  make(map[string]dnsCacheEntry),
+	}
+
+	server := strings.TrimSpace(settings.DNSServer)
+	switch {
+	case server == "" || strings.EqualFold(server, "system"):
+	case strings.HasPrefix(server, "https://"):
+		r.server, r.network = server, "https"
+		r.doh = &http.Client{
+			Timeout: dnsTimeout,
+			Transport: &http.Transport{
+				DialContext:       egress.apply(&net.Dialer{}, "tcp").DialContext,
+				ForceAttemptHTTP2: true,
+			},
+		}
+	default:
+		r.network = "udp"
+		if scheme, rest, ok := strings.Cut(server, "://"); ok {
+			if scheme != "udp" && scheme != "tcp" {
+				return nil, fmt.Errorf("invalid DNS server %q: unsupported scheme %s", server, scheme)
+			}
+			r.network, server = scheme, rest
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		if _, err := netip.ParseAddrPort(server); err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q: must be an IP address", settings.DNSServer)
+		}
+		r.server = server
+	}
+
+	// Host overrides use the hosts file format: "address name [name...]"
+	for _, line := range settings.DNSHosts {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("invalid DNS host override %q: want \"address name\"", line)
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			r.hosts[name] = append(r.hosts[name], addr.Unmap())
+		}
+	}
+	return r, nil
+}
+
+// normalizeHost lowercases a name and drops its trailing dot
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// describe names the resolver for logs
+func (r *dnsResolver) describe() string {
+	switch r.network {
+	case "":
+		return "system"
+	case "https":
+		return r.server
+	default:
+		return r.network + "://" + r.server
+	}
+}
+
+// lookup returns the addresses of host. IP literals are returned as is.
+func (r *dnsResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	name := normalizeHost(host)
+	if addrs, ok := r.hosts[name]; ok {
+		r.log(LevelDebug, fmt.Sprintf("DNS %s -> %s (hosts)", name, formatAddrs(addrs)))
+		return addrs, nil
+	}
+
+	r.mu.Lock()
+	entry, ok := r.cache[name]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		r.log(LevelDebug, fmt.Sprintf("DNS %s -> %s (cached)", name, formatAddrs(entry.addrs)))
+		return entry.addrs, nil
+	}
+
+	start := time.Now()
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var err error
+	if r.network == "" {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+		ttl = systemDNSTTL
+	} else {
+		addrs, ttl, err = r.query(ctx, name)
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		r.log(LevelDebug, fmt.Sprintf("DNS %s failed after %s via %s: %v", name, elapsed, r.describe(), err))
+		return nil, err
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	r.log(LevelDebug, fmt.Sprintf("DNS %s -> %s in %s via %s (ttl %s)", name, formatAddrs(addrs), elapsed, r.describe(), ttl))
+	r.store(name, addrs, ttl)
+	return addrs, nil
+}
+
+// store caches an answer for ttl
+func (r *dnsResolver) store(name string, addrs []netip.Addr, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= maxDNSCacheEntries {
+		for key, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, key)
+			}
+		}
+		if len(r.cache) >= maxDNSCacheEntries {
+			clear(r.cache)
+		}
+	}
+	r.cache[name] = dnsCacheEntry{addrs: addrs, expires: now.Add(min(ttl, maxDNSTTL))}
+}
+
+// query asks the configured server for the A and AAAA records of name. The
+// returned TTL is the smallest TTL of the answers.
+func (r *dnsResolver) query(ctx context.Context, name string) ([]netip.Addr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	type answer struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &answers[i]
+			a.addrs, a.ttl, a.err = r.queryType(ctx, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	ttl := maxDNSTTL
+	var firstErr error
+	for _, a := range answers {
+		if a.err != nil {
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			continue
+		}
+		addrs = append(addrs, a.addrs...)
+		if len(a.addrs) > 0 {
+			ttl = min(ttl, a.ttl)
+		}
+	}
+	if len(addrs) == 0 {
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no such host", Name: name, Server: r.describe(), IsNotFound: true}
+		}
+		return nil, 0, firstErr
+	}
+	return addrs, ttl, nil
+}
+
+// queryType sends one question and parses the addresses in the answer
+func (r *dnsResolver) queryType(ctx context.Context, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	if r.network == "https" {
+		// RFC 8484 asks for ID 0 so responses can be cached by HTTP caches
+		msg.Header.ID = 0
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var reply []byte
+	switch r.network {
+	case "https":
+		reply, err = r.exchangeHTTPS(ctx, query)
+	case "tcp":
+		reply, err = r.exchangeTCP(ctx, query)
+	default:
+		reply, err = r.exchangeUDP(ctx, query)
+	}
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name, Server: r.describe(), IsTimeout: errors.Is(err, context.DeadlineExceeded)}
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(reply); err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid response: " + err.Error(), Name: name, Server: r.describe()}
+	}
+	if resp.Header.ID != msg.Header.ID {
+		return nil, 0, &net.DNSError{Err: "response ID mismatch", Name: name, Server: r.describe()}
+	}
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: r.describe(), IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server error: " + resp.Header.RCode.String(), Name: name, Server: r.describe()}
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	for _, rr := range resp.Answers {
+		var addr netip.Addr
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA)
+		default:
+			continue // CNAMEs are followed by the server
+		}
+		rrTTL := time.Duration(rr.Header.TTL) * time.Second
+		if len(addrs) == 0 || rrTTL < ttl {
+			ttl = rrTTL
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, ttl, nil
+}
+
+// exchangeUDP sends a query over UDP, retrying over TCP if the answer was truncated
+func (r *dnsResolver) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := r.egress.apply(&net.Dialer{}, "udp").DialContext(ctx, "udp", r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	var header dnsmessage.Parser
+	if h, err := header.Start(buf[:n]); err == nil && h.Truncated {
+		return r.exchangeTCP(ctx, query)
+	}
+	return buf[:n], nil
+}
+
+// exchangeTCP sends a length-prefixed query over TCP
+func (r *dnsResolver) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := r.egress.apply(&net.Dialer{}, "tcp").DialContext(ctx, "tcp", r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// exchangeHTTPS posts a query to a DNS-over-HTTPS server (RFC 8484)
+func (r *dnsResolver) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.doh.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+}
+
+// formatAddrs joins addresses for logs
+func formatAddrs(addrs []netip.Addr) string {
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = addr.String()
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsAnswer answers an A question with 192.0.2.10 and any other question
+// with no records
+func dnsAnswer(query []byte, ttl uint32) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	msg.Header.Response = true
+	for _, q := range msg.Questions {
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+			})
+		}
+	}
+	reply, _ := msg.Pack()
+	return reply
+}
+
+// udpDNSServer is a stand-in DNS server counting the questions it answers
+func udpDNSServer(t *testing.T, ttl uint32) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			conn.WriteTo(dnsAnswer(buf[:n], ttl), from)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func testResolver(t *testing.T, settings ProxySettings) *dnsResolver {
+	t.Helper()
+	r, err := newDNSResolver(settings, nil, func(level, msg string) { t.Logf("%s %s", level, msg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func lookupOne(t *testing.T, r *dnsResolver, host string) netip.Addr {
+	t.Helper()
+	addrs, err := r.lookup(context.Background(), host)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", host, err)
+	}
+	if len(addrs) != 1 {
+		t.Fatalf("lookup %s: got %v, want one address", host, addrs)
+	}
+	return addrs[0]
+}
+
+func TestDNSHostsOverrideServer(t *testing.T) {
+	server, queries := udpDNSServer(t, 60)
+	r := testResolver(t, ProxySettings{
+		DNSServer: server,
+		DNSHosts:  []string{"# internal names", "10.1.2.3 API.Corp.Example gateway.corp.example. # comment", "", "::ffff:10.9.9.9 mapped.example"},
+	})
+
+	for host, want := range map[string]string{
+		"api.corp.example":      "10.1.2.3",
+		"gateway.corp.example":  "10.1.2.3",
+		"GATEWAY.corp.example.": "10.1.2.3",
+		"mapped.example":        "10.9.9.9",
+	} {
+		if got := lookupOne(t, r, host); got.String() != want {
+			t.Errorf("%s: got %s, want %s", host, got, want)
+		}
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("overridden names sent %d queries to the server", n)
+	}
+	if got := lookupOne(t, r, "other.example"); got.String() != "192.0.2.10" {
+		t.Errorf("other.example: got %s from the server, want 192.0.2.10", got)
+	}
+}
+
+func TestDNSCacheFollowsTTL(t *testing.T) {
+	for _, tc := range []struct {
+		ttl         uint32
+		wantQueries int32
+	}{
+		{60, 2}, // A and AAAA once, then from the cache
+		{0, 6},  // a zero TTL is never cached
+	} {
+		server, queries := udpDNSServer(t, tc.ttl)
+		r := testResolver(t, ProxySettings{DNSServer: "udp://" + server})
+		for i := 0; i < 3; i++ {
+			lookupOne(t, r, "cached.example")
+		}
+		if n := queries.Load(); n != tc.wantQueries {
+			t.Errorf("ttl %d: server saw %d queries, want %d", tc.ttl, n, tc.wantQueries)
+		}
+	}
+}
+
+func TestDNSServerTransports(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				reply := dnsAnswer(query, 60)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...))
+			}()
+		}
+	}()
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || binary.BigEndian.Uint16(query) != 0 {
+			http.Error(w, "not an RFC 8484 query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, 60))
+	}))
+	t.Cleanup(doh.Close)
+
+	tcp := testResolver(t, ProxySettings{DNSServer: "tcp://" + listener.Addr().String()})
+	https := testResolver(t, ProxySettings{DNSServer: doh.URL + "/dns-query"})
+	https.doh = doh.Client()
+	for name, r := range map[string]*dnsResolver{"tcp": tcp, "https": https} {
+		if got := lookupOne(t, r, "remote.example"); got.String() != "192.0.2.10" {
+			t.Errorf("%s: got %s, want 192.0.2.10", name, got)
+		}
+	}
+}
+
+func TestDNSSettingsValidation(t *testing.T) {
+	for _, settings := range []ProxySettings{
+		{DNSServer: "ftp://192.0.2.53"},
+		{DNSServer: "dns.example"},
+		{DNSHosts: []string{"not-an-address example.com"}},
+		{DNSHosts: []string{"192.0.2.1"}},
+	} {
+		if _, err := newDNSResolver(settings, nil, nil); err == nil {
+			t.Errorf("%+v: accepted", settings)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// anthropicAPIOrigin receives the requests of the reverse proxy
+	anthropicAPIOrigin = "https://api.anthropic.com"
+	// defaultReversePrefix is the path B's ANTHROPIC_BASE_URL points at
+	defaultReversePrefix = "/anthropic"
+	// reverseAuthHeader carries "Basic <credentials>" for reverse-proxy
+	// requests when proxy users are configured. Authorization and x-api-key
+	// belong to the API, and SDKs do not answer a 407.
+	reverseAuthHeader = "X-Claude-Proxy-Authorization"
+)
+
+// reverseProxy serves origin-form requests below a path prefix, e.g.
+// "http://127.0.0.1:8080/anthropic/v1/messages", by sending them to the
+// Anthropic API. B then only sets ANTHROPIC_BASE_URL instead of a proxy
+// that every other tool would pick up as well.
+type reverseProxy struct {
+	prefix string // without trailing slash, "" for every path
+	origin *url.URL
+}
+
+// newReverseProxy returns nil when the record does not enable the reverse proxy
+func newReverseProxy(settings ProxySettings) (*reverseProxy, error) {
+	if !settings.ReverseProxy {
+		return nil, nil
+	}
+	prefix := strings.TrimSpace(settings.ReversePrefix)
+	if prefix == "" {
+		prefix = defaultReversePrefix
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#") {
+		return nil, fmt.Errorf("invalid reverse proxy prefix %q: want a path such as %s", prefix, defaultReversePrefix)
+	}
+	origin, _ := url.Parse(anthropicAPIOrigin)
+	return &reverseProxy{prefix: strings.TrimRight(prefix, "/"), origin: origin}, nil
+}
+
+// matches reports whether r is an origin-form request below the prefix;
+// absolute-form requests are regular proxy requests
+func (rp *reverseProxy) matches(r *http.Request) bool {
+	if rp == nil || r.URL.Host != "" || !strings.HasPrefix(r.URL.Path, "/") {
+		return false
+	}
+	return r.URL.Path == rp.prefix || strings.HasPrefix(r.URL.Path, rp.prefix+"/")
+}
+
+// target maps a request path below the prefix onto the API origin
+func (rp *reverseProxy) target(u *url.URL) *url.URL {
+	target := *rp.origin
+	target.Path = "/" + strings.TrimLeft(strings.TrimPrefix(u.Path, rp.prefix), "/")
+	if u.RawPath != "" {
+		target.RawPath = "/" + strings.TrimLeft(strings.TrimPrefix(u.RawPath, rp.prefix), "/")
+	}
+	target.RawQuery = u.RawQuery
+	return &target
+}
+
+// handleReverse rewrites a reverse-proxy request to the API origin and
+// forwards it like a plain proxy request, so policy, routing, upstream
+// proxies and response streaming apply unchanged. The client's Host is kept
+// for Forwarded; the outgoing Host comes from the rewritten URL.
+func (p *ProxyServer) handleReverse(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.Header.Del(reverseAuthHeader)
+	out.URL = p.reverse.target(r.URL)
+	out.RequestURI = ""
+	p.handleHTTP(w, out, "API")
+}
+
+// rejectReverseAuth answers an unauthenticated reverse-proxy request with a
+// 401 in the API's error format, so SDKs show the reason
+func rejectReverseAuth(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, `{"type":"error","error":{"type":"authentication_error","message":"claude-proxy requires a %s: Basic <base64 user:password> header"}}`, reverseAuthHeader)
+}
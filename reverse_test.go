@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// startReverseProxy runs a proxy whose reverse mode forwards to a local
+// stand-in for the API origin, which sees every request on seen
+func startReverseProxy(t *testing.T, config *Config) (*ProxyServer, chan *http.Request) {
+	t.Helper()
+	seen := make(chan *http.Request, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r
+		w.Write([]byte("api " + r.URL.RequestURI()))
+	}))
+	t.Cleanup(api.Close)
+
+	config.ReverseProxy = true
+	p := startTestProxy(t, config)
+	p.reverse.origin, _ = url.Parse(api.URL)
+	return p, seen
+}
+
+func TestReverseProxyAuthUsesOrdinaryHeader(t *testing.T) {
+	config := loopbackConfig()
+	config.ProxyUsers = []string{"alice:s3cret"}
+	p, seen := startReverseProxy(t, config)
+	endpoint := p.proxyURL().String() + "/anthropic/v1/messages"
+
+	resp, err := http.Post(endpoint, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Proxy-Authenticate") != "" ||
+		!strings.Contains(string(body), `"authentication_error"`) {
+		t.Fatalf("unauthenticated request: got %s %q, want a 401 API error", resp.Status, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, endpoint, strings.NewReader("{}"))
+	req.Header.Set(reverseAuthHeader, "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:s3cret")))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated request: got %s", resp.Status)
+	}
+	if forwarded := <-seen; forwarded.Header.Get(reverseAuthHeader) != "" {
+		t.Errorf("%s was forwarded to the API", reverseAuthHeader)
+	}
+}
+
+func TestReverseProxyRewritesPathAndHost(t *testing.T) {
+	p, seen := startReverseProxy(t, loopbackConfig())
+	base := p.proxyURL().String()
+
+	for path, want := range map[string]string{
+		"/anthropic/v1/messages?beta=true": "/v1/messages?beta=true",
+		"/anthropic/v1/files/a%2Fb":        "/v1/files/a%2Fb",
+		"/anthropic":                       "/",
+	} {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "api "+want {
+			t.Errorf("%s: got %s %q, want it forwarded as %s", path, resp.Status, body, want)
+			continue
+		}
+		forwarded := <-seen
+		if forwarded.Host != p.reverse.origin.Host {
+			t.Errorf("%s: API saw Host %q, want %q", path, forwarded.Host, p.reverse.origin.Host)
+		}
+	}
+
+	// Paths outside the prefix and absolute-form requests are not sent to the API
+	resp, err := http.Get(base + "/anthropicx/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("path outside the prefix: got %s", resp.Status)
+	}
+	origin := newOrigin(t)
+	resp, err = proxyClient(p).Get(origin.URL + "/anthropic/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello /anthropic/v1/messages" {
+		t.Errorf("absolute-form request: got %s %q, want it proxied to its own origin", resp.Status, body)
+	}
+	select {
+	case r := <-seen:
+		t.Errorf("API received %s", r.URL)
+	default:
+	}
+}
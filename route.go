@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Route rule targets besides an explicit upstream proxy URL
+const (
+	routeDirect   = "direct"   // connect without an upstream proxy
+	routeUpstream = "upstream" // the record's PAC script, failover list or proxy settings
+	routeBlock    = "block"    // refuse like a policy deny
+)
+
+// routeRule is one "host[:ports] route" line
+type routeRule struct {
+	text  string
+	route string // routeDirect, routeUpstream, routeBlock or an upstream proxy URL
+	destPattern
+}
+
+// routeTable is an ordered list of routing rules; the first matching rule
+// picks the route and unmatched destinations use the record's upstreams
+type routeTable struct {
+	rules []routeRule
+	cidr  bool // some rule matches by CIDR, so named destinations are resolved
+}
+
+// newRouteTable parses the record's routing rules, e.g.
+// "*.anthropic.com upstream", "10.0.0.0/8 direct", "* block" or
+// "*.github.com socks5h://127.0.0.1:7890". It returns nil without rules.
+func newRouteTable(lines []string) (*routeTable, error) {
+	table := &routeTable{}
+	for _, line := range lines {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid route rule %q: expected \"host[:ports] direct|upstream|block|proxy URL\"", line)
+		}
+		dest, err := parseDestPattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid route rule %q: %w", line, err)
+		}
+		rule := routeRule{text: line, destPattern: dest}
+		switch route := strings.ToLower(fields[1]); route {
+		case routeDirect, routeUpstream, routeBlock:
+			rule.route = route
+		default:
+			if !strings.Contains(fields[1], "://") {
+				return nil, fmt.Errorf("invalid route rule %q: unknown route %q", line, fields[1])
+			}
+			if _, err := parseUpstreamProxy(fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid route rule %q: %w", line, err)
+			}
+			rule.route = fields[1]
+			rule.text = fields[0] + " " + routeName(fields[1])
+		}
+		table.rules = append(table.rules, rule)
+		table.cidr = table.cidr || rule.glob == ""
+	}
+	if len(table.rules) == 0 {
+		return nil, nil
+	}
+	return table, nil
+}
+
+// hasCIDR reports whether named destinations must be resolved for routing
+func (t *routeTable) hasCIDR() bool {
+	return t != nil && t.cidr
+}
+
+// match returns the first rule covering target (host:port), or nil. addrs
+// are the addresses target's host resolved to, nil when it did not resolve;
+// a block rule by CIDR then blocks, other CIDR rules are skipped.
+func (t *routeTable) match(target string, addrs []netip.Addr) *routeRule {
+	if t == nil {
+		return nil
+	}
+	host, port, ok := splitRuleTarget(target)
+	if !ok {
+		return nil
+	}
+	for i := range t.rules {
+		rule := &t.rules[i]
+		if rule.matches(host, port, addrs) || (rule.route == routeBlock && rule.unresolved(host, port, addrs)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// routeFor returns the upstream proxies to try for a destination, in order;
+// an empty string means a direct connection. The first matching route rule
+// decides, otherwise the record's upstreams do.
+func (p *ProxyServer) routeFor(ctx context.Context, target *url.URL, static string) ([]string, error) {
+	hostPort := requestTarget(target)
+	rule := p.routes.match(hostPort, p.targetAddrs(ctx, hostPort))
+	if rule == nil {
+		upstreams := p.upstreamsFor(target, static)
+		p.log(LevelDebug, fmt.Sprintf("Route %s -> %s", hostPort, routeNames(upstreams)))
+		return upstreams, nil
+	}
+
+	var upstreams []string
+	switch rule.route {
+	case routeBlock:
+		return nil, &policyError{target: hostPort, rule: rule.text}
+	case routeDirect:
+		upstreams = []string{""}
+	case routeUpstream:
+		upstreams = p.upstreamsFor(target, static)
+	default:
+		upstreams = []string{rule.route}
+	}
+	p.log(LevelDebug, fmt.Sprintf("Route %s -> %s (rule %q)", hostPort, routeNames(upstreams), rule.text))
+	return upstreams, nil
+}
+
+// routeNames describes a list of upstreams for logs
+func routeNames(upstreams []string) string {
+	names := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		names[i] = routeName(upstream)
+	}
+	return strings.Join(names, "; ")
+}
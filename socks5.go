@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version    = 0x05
+	socksAuthVersion = 0x01
+
+	socksMethodNone         = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyNetworkUnreachable  = 0x03
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyTTLExpired          = 0x06
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// socksHandshakeTimeout bounds the greeting, auth and request (a variable
+// so tests can shorten it)
+var socksHandshakeTimeout = 30 * time.Second
+
+// socksReplyTimeout bounds writing a reply to a client that stopped reading
+const socksReplyTimeout = 10 * time.Second
+
+// socksRequestError carries the reply code to send back for a bad request
+type socksRequestError struct {
+	reply byte
+	msg   string
+}
+
+func (e *socksRequestError) Error() string {
+	return e.msg
+}
+
+// handleSOCKS5 serves one SOCKS5 client connection (CONNECT only)
+func (p *ProxyServer) handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	// The handshake must complete in time. Waiting for a limit and dialing
+	// have their own bounds, and the tunnel itself has no deadline.
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	user, err := p.socks5Handshake(conn)
+	if err != nil {
+		p.log(LevelDebug, fmt.Sprintf("SOCKS5 handshake failed from %s: %v", conn.RemoteAddr(), err))
+		return
+	}
+
+	target, err := readSOCKS5Request(conn)
+	if err != nil {
+		var reqErr *socksRequestError
+		if errors.As(err, &reqErr) {
+			writeSOCKS5Reply(conn, reqErr.reply, nil)
+		}
+		p.log(LevelDebug, fmt.Sprintf("SOCKS5 request rejected: %v", err))
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.log(LevelDebug, fmt.Sprintf(">> 收到 SOCKS5 请求: %s%s", target, userSuffix(user)))
+
+	ex := p.beginExchange("SOCKS5", target, conn.RemoteAddr().String(), user)
+	defer p.finishExchange(ex)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ex.setCloser(connConnecting, func() {
+		cancel()
+		conn.Close()
+	})
+
+	if err := p.checkPolicy(ctx, "SOCKS5", target); err != nil {
+		ex.result = trafficDenied
+		writeSOCKS5Reply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+
+	// A client hanging up while queued for a limit gives its place back
+	stopWatching := watchHangup(conn, cancel)
+	release, err := p.admit(ctx, ex)
+	stopWatching()
+	if err != nil {
+		if errors.Is(err, errTooManyConnections) || errors.Is(err, errRateLimited) {
+			ex.result = trafficLimited
+		}
+		writeSOCKS5Reply(conn, socksReplyNotAllowed, nil)
+		p.log(LevelInfo, fmt.Sprintf("Rejected SOCKS5 %s%s: %v", target, userSuffix(user), err))
+		return
+	}
+	defer release()
+
+	targetConn, err := p.dialTarget(ctx, target)
+	if err != nil {
+		ex.result = dialResult(err)
+		writeSOCKS5Reply(conn, socksReplyForError(err), nil)
+		p.log(LevelError, fmt.Sprintf("Failed to connect to %s: %v", target, err))
+		return
+	}
+	defer targetConn.Close()
+
+	if err := writeSOCKS5Reply(conn, socksReplySucceeded, targetConn.LocalAddr()); err != nil {
+		p.log(LevelError, fmt.Sprintf("Failed to send SOCKS5 reply: %v", err))
+		return
+	}
+	ex.setCloser(connOpen, func() {
+		conn.Close()
+		targetConn.Close()
+	})
+
+	ex.result = trafficOK
+	p.relay(&countingConn{ReadWriteCloser: conn, ex: ex}, targetConn, p.timeouts.forTarget(target))
+	p.log(LevelDebug, fmt.Sprintf("SOCKS5 %s completed", target))
+}
+
+// watchHangup cancels a request when its client disconnects before the
+// reply. Bytes the client sends early stay buffered for the tunnel. The
+// returned stop function must be called before conn is read again.
+func watchHangup(conn net.Conn, cancel context.CancelFunc) func() {
+	buffered, ok := conn.(*bufferedConn)
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var netErr net.Error
+		if _, err := buffered.r.Peek(1); err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			cancel()
+		}
+	}()
+	return func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// socks5Handshake negotiates the auth method and returns the authenticated
+// user name (empty when no authentication is configured)
+func (p *ProxyServer) socks5Handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksMethodNone)
+	if len(p.users) > 0 {
+		method = socksMethodUserPass
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socks5Version, socksMethodNoAcceptable})
+		return "", fmt.Errorf("client does not offer auth method %d", method)
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNone {
+		return "", nil
+	}
+
+	// Username/password sub-negotiation (RFC 1929)
+	user, password, err := readSOCKS5Credentials(conn)
+	if err != nil {
+		return "", err
+	}
+	if !p.checkProxyUser(user, password) {
+		conn.Write([]byte{socksAuthVersion, 0x01})
+		p.log(LevelInfo, fmt.Sprintf("Proxy authentication failed for user %q from %s", user, conn.RemoteAddr()))
+		return "", fmt.Errorf("invalid credentials for user %q", user)
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// readSOCKS5Credentials reads an RFC 1929 username/password request
+func readSOCKS5Credentials(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksAuthVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(r, plen); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+	return string(user), string(password), nil
+}
+
+// readSOCKS5Request reads a SOCKS5 request and returns its host:port target
+func readSOCKS5Request(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if header[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", &socksRequestError{socksReplyAddressNotSupported, fmt.Sprintf("unsupported address type %d", header[3])}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	if header[1] != socksCmdConnect {
+		return "", &socksRequestError{socksReplyCommandNotSupported, fmt.Sprintf("unsupported command %d for %s", header[1], target)}
+	}
+	return target, nil
+}
+
+// writeSOCKS5Reply sends a SOCKS5 reply with the given bound address,
+// within socksReplyTimeout
+func writeSOCKS5Reply(conn net.Conn, reply byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip = addr.IP
+		port = addr.Port
+	}
+
+	msg := []byte{socks5Version, reply, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, socksAtypIPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, socksAtypIPv6)
+		msg = append(msg, ip.To16()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+
+	conn.SetWriteDeadline(time.Now().Add(socksReplyTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(msg)
+	return err
+}
+
+// socksReplyForError maps a dial error to the closest SOCKS5 reply code
+func socksReplyForError(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errUpstreamForbidden), errors.Is(err, errPrivateNetwork):
+		return socksReplyNotAllowed
+	case errors.Is(err, errUpstreamTimeout):
+		return socksReplyTTLExpired
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksReplyHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socksReplyTTLExpired
+	}
+	return socksReplyGeneralFailure
+}
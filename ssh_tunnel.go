@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -21,9 +22,13 @@ type SSHTunnel struct {
 	listener        net.Listener
 	mu              sync.Mutex
 	stopChan        chan struct{}
+	stopped         bool
 	reconnect       bool
+	draining        bool         // Drain closed the listener; keep the client until Stop
+	active          atomic.Int64 // forwarded connections in progress
 	OnStatusChange  func(connected bool, err error)
 	PasswordPrompt  func() string // Callback to prompt for password if needed
+	origins         *clientOrigins // where each forwarded connection came from on B
 	log             LogFunc
 }
 
@@ -255,6 +260,14 @@ func (t *SSHTunnel) connect(ctx context.Context) error {
 
 		remoteConn, err := listener.Accept()
 		if err != nil {
+			t.mu.Lock()
+			draining := t.draining
+			t.mu.Unlock()
+			if draining {
+				// Closing the client now would cut the open connections
+				<-t.stopChan
+				return nil
+			}
 			select {
 			case <-t.stopChan:
 				return nil
@@ -263,12 +276,14 @@ func (t *SSHTunnel) connect(ctx context.Context) error {
 			}
 		}
 
+		t.active.Add(1)
 		go t.handleRemoteConnection(remoteConn)
 	}
 }
 
 // handleRemoteConnection forwards remote connection to local proxy
 func (t *SSHTunnel) handleRemoteConnection(remoteConn net.Conn) {
+	defer t.active.Add(-1)
 	defer remoteConn.Close()
 
 	// Connect to local proxy
@@ -280,18 +295,27 @@ func (t *SSHTunnel) handleRemoteConnection(remoteConn net.Conn) {
 	}
 	defer localConn.Close()
 
-	// Bidirectional copy
+	// Let the proxy show which client on B opened this connection
+	local := localConn.LocalAddr().String()
+	t.origins.add(local, remoteConn.RemoteAddr().String())
+	defer t.origins.remove(local)
+
+	// Bidirectional copy; each side is half-closed when the other is done,
+	// so a proxy that closes the connection (e.g. while draining) lets the
+	// client on B see EOF
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
 		io.Copy(localConn, remoteConn)
+		closeWrite(localConn)
 	}()
 
 	go func() {
 		defer wg.Done()
 		io.Copy(remoteConn, localConn)
+		closeWrite(remoteConn)
 	}()
 
 	wg.Wait()
@@ -344,6 +368,11 @@ func (t *SSHTunnel) loadPrivateKeyFromPath(keyPath string) (ssh.AuthMethod, erro
 // Stop stops the SSH tunnel
 func (t *SSHTunnel) Stop() {
 	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
 	t.reconnect = false
 	close(t.stopChan)
 
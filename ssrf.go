@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// errPrivateNetwork is returned when a destination resolves to one of A's
+// own or internal addresses
+var errPrivateNetwork = errors.New("destination is on a private network")
+
+// blockedNetworks are unreachable through the proxy unless re-enabled per record
+var blockedNetworks = []struct {
+	prefix netip.Prefix
+	name   string
+}{
+	{netip.MustParsePrefix("169.254.169.254/32"), "cloud metadata"},
+	{netip.MustParsePrefix("0.0.0.0/8"), "unspecified"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local"},
+	{netip.MustParsePrefix("::/128"), "unspecified"},
+	{netip.MustParsePrefix("::1/128"), "loopback"},
+	{netip.MustParsePrefix("fc00::/7"), "private"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local"},
+}
+
+// ssrfGuard keeps clients on B from reaching A's loopback and internal
+// networks through the tunnel
+type ssrfGuard struct {
+	allowed []netip.Prefix
+}
+
+// ssrfError names the blocked address a destination resolved to
+type ssrfError struct {
+	target string
+	addr   netip.Addr
+	kind   string
+}
+
+func (e *ssrfError) Error() string {
+	return fmt.Sprintf("%s: %s -> %s (%s)", errPrivateNetwork, e.target, e.addr, e.kind)
+}
+
+func (e *ssrfError) Unwrap() error {
+	return errPrivateNetwork
+}
+
+// newSSRFGuard parses the CIDRs re-enabled for this record
+func newSSRFGuard(allowed []string) (*ssrfGuard, error) {
+	guard := &ssrfGuard{}
+	for _, entry := range allowed {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid allowed private network %q: %w", entry, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		guard.allowed = append(guard.allowed, prefix.Masked())
+	}
+	return guard, nil
+}
+
+// privateAddr reports whether addr is in one of the blocked networks
+func privateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, blocked := range blockedNetworks {
+		if blocked.prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr rejects blocked addresses that are not explicitly allowed
+func (g *ssrfGuard) checkAddr(target string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	for _, blocked := range blockedNetworks {
+		if blocked.prefix.Contains(addr) {
+			return &ssrfError{target: target, addr: addr, kind: blocked.name}
+		}
+	}
+	return nil
+}
+
+// checkAddrs rejects target if any of its addresses is blocked
+func (g *ssrfGuard) checkAddrs(target string, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		if err := g.checkAddr(target, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTarget rejects host:port if the host is a blocked address. Names are
+// checked once resolved: by dialDirect, or by checkUpstreamTarget when an
+// upstream proxy is involved.
+func (g *ssrfGuard) checkTarget(target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return g.checkAddr(target, addr)
+	}
+	return nil
+}
+
+// dialer returns a dialer that checks the address actually connected to,
+// in case an address slips past the resolved-name check
+func (g *ssrfGuard) dialer(target string) *net.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return g.checkAddr(target, addrPort.Addr())
+		},
+	}
+}
+
+// dialDirect connects to target without an upstream proxy, resolving it with
+// the record's resolver and enforcing the guard on every address
+func (p *ProxyServer) dialDirect(ctx context.Context, target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := p.resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.guard.checkAddrs(target, addrs); err != nil {
+		return nil, err
+	}
+	return p.dialAddrs(ctx, target, addrs, port)
+}
+
+// checkUpstreamTarget runs the guard on a target handed to an upstream
+// proxy. A remote upstream resolves names in its own network, but one on A's
+// loopback or LAN (a local Clash or V2Ray) reaches everything A does, so
+// there the name is resolved with the record's resolver and every address
+// is checked. A name that does not resolve on A is refused.
+func (p *ProxyServer) checkUpstreamTarget(ctx context.Context, upstream *upstreamProxy, target string) error {
+	if err := p.guard.checkTarget(target); err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if _, err := netip.ParseAddr(host); err == nil || !p.localUpstream(ctx, upstream) {
+		return nil
+	}
+	addrs, err := p.resolver.lookup(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%w: cannot check %s for local upstream %s: %v", errPrivateNetwork, target, upstream, err)
+	}
+	return p.guard.checkAddrs(target, addrs)
+}
+
+// checkUpstreamRoute is checkUpstreamTarget for an upstream proxy URL; an
+// invalid URL is left for the transport to report
+func (p *ProxyServer) checkUpstreamRoute(ctx context.Context, proxyURL, target string) error {
+	upstream, err := parseUpstreamProxy(proxyURL)
+	if err != nil {
+		return nil
+	}
+	return p.checkUpstreamTarget(ctx, upstream, target)
+}
+
+// localUpstream reports whether an upstream proxy listens on A's loopback
+// or internal networks
+func (p *ProxyServer) localUpstream(ctx context.Context, upstream *upstreamProxy) bool {
+	host := upstream.url.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	addrs, err := p.resolver.lookup(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if privateAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
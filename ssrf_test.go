@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// countingListener is a stand-in upstream that only counts connections
+func countingListener(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+func TestLocalUpstreamGetsResolvedTargetsChecked(t *testing.T) {
+	upstream, accepted := countingListener(t)
+	config := &Config{}
+	config.HTTPSProxy = "http://" + upstream
+	config.HTTPProxy = "http://" + upstream
+	config.DNSHosts = []string{"127.0.0.1 sneaky.test", "192.168.1.1 router.test"}
+	p := startTestProxy(t, config)
+
+	for _, target := range []string{"sneaky.test:22", "router.test:80", "localhost:22"} {
+		conn, err := net.Dial("tcp", p.proxyURL().Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("CONNECT %s through a local upstream: got %s, want 403", target, resp.Status)
+		}
+	}
+
+	resp, err := proxyClient(p).Get("http://sneaky.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET through a local upstream: got %s, want 403", resp.Status)
+	}
+	if n := accepted.Load(); n != 0 {
+		t.Errorf("upstream saw %d connections for blocked targets", n)
+	}
+}
+
+func TestSOCKS5UpstreamChecksLocallyResolvedTarget(t *testing.T) {
+	p := startTestProxy(t, &Config{ProxySettings: ProxySettings{DNSHosts: []string{"10.0.0.5 intranet.test"}}})
+	upstream, err := parseUpstreamProxy("socks5://203.0.113.1:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	err = p.socks5Connect(context.Background(), client, upstream, "intranet.test:443")
+	if !errors.Is(err, errPrivateNetwork) {
+		t.Fatalf("got %v, want the private address refused before it is sent", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exchange results
+const (
+	trafficOK      = "ok"
+	trafficDenied  = "denied"
+	trafficLimited = "limited"
+	trafficError   = "error"
+)
+
+// topHostsLimit is the number of hosts reported by TrafficStats.Snapshot
+const topHostsLimit = 10
+
+const (
+	// maxTrackedHosts bounds the per-host counters; beyond it the host with
+	// the least traffic is folded into otherHosts
+	maxTrackedHosts = 1000
+	// otherHosts is the bucket for hosts no longer tracked individually
+	otherHosts = "(other)"
+)
+
+// TrafficCounters are the totals of a set of proxy exchanges
+type TrafficCounters struct {
+	Requests   int64 `json:"requests"`
+	Errors     int64 `json:"errors"`
+	Denied     int64 `json:"denied"`
+	Limited    int64 `json:"limited"`
+	BytesUp    int64 `json:"bytes_up"`   // client -> destination
+	BytesDown  int64 `json:"bytes_down"` // destination -> client
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// TrafficEntry is the traffic of one destination host or record
+type TrafficEntry struct {
+	Name string `json:"name"`
+	TrafficCounters
+}
+
+// TrafficSnapshot is a point-in-time view of the traffic counters.
+// Bytes of exchanges still in progress are included.
+type TrafficSnapshot struct {
+	Since   string          `json:"since"`
+	Active  int             `json:"active"`
+	Totals  TrafficCounters `json:"totals"`
+	Hosts   []TrafficEntry  `json:"hosts"`   // busiest hosts first, at most topHostsLimit
+	Records []TrafficEntry  `json:"records"` // busiest records first
+}
+
+// TrafficStats aggregates CONNECT, SOCKS5 and plain-HTTP exchanges per
+// destination host and per record. It outlives ProxyServer restarts.
+type TrafficStats struct {
+	mu      sync.Mutex
+	nextID  uint64
+	since   time.Time
+	totals  TrafficCounters
+	hosts   map[string]*TrafficCounters
+	records map[string]*TrafficCounters
+	active  map[*trafficExchange]struct{}
+}
+
+// NewTrafficStats creates empty traffic counters
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		since:   time.Now(),
+		hosts:   make(map[string]*TrafficCounters),
+		records: make(map[string]*TrafficCounters),
+		active:  make(map[*trafficExchange]struct{}),
+	}
+}
+
+// trafficExchange is one CONNECT tunnel, SOCKS5 tunnel or HTTP request in
+// progress. The byte counters are updated without holding the stats lock.
+type trafficExchange struct {
+	host   string
+	record string
+	start  time.Time
+	result string
+	up     atomic.Int64
+	down   atomic.Int64
+
+	// Set by ProxyServer.beginExchange for the connection table; the id
+	// is unique across proxy restarts
+	id       uint64
+	kind     string
+	target   string
+	client   string
+	tunneled bool
+	user     string
+
+	mu     sync.Mutex
+	state  string
+	closer func()
+	killed bool
+	done   chan struct{} // closed when the exchange is killed
+
+	bandwidth []*rateLimiter // set by ProxyServer.admit
+	priority  bool
+	scheduler *priorityScheduler
+}
+
+// begin registers a new exchange to target (host or host:port). The caller
+// sets result and must call finish when the exchange is over.
+func (s *TrafficStats) begin(target, record string) *trafficExchange {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	ex := &trafficExchange{
+		host:   strings.ToLower(strings.TrimSuffix(host, ".")),
+		record: record,
+		start:  time.Now(),
+		result: trafficError,
+		done:   make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	ex.id = s.nextID
+	s.active[ex] = struct{}{}
+	s.mu.Unlock()
+	return ex
+}
+
+// finish folds a completed exchange into the totals
+func (s *TrafficStats) finish(ex *trafficExchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.active, ex)
+	duration := time.Since(ex.start).Milliseconds()
+	for _, counters := range []*TrafficCounters{&s.totals, s.hostCounters(ex.host), counterFor(s.records, ex.record)} {
+		counters.Requests++
+		counters.BytesUp += ex.up.Load()
+		counters.BytesDown += ex.down.Load()
+		counters.DurationMs += duration
+		switch ex.result {
+		case trafficDenied:
+			counters.Denied++
+		case trafficLimited:
+			counters.Limited++
+		case trafficError:
+			counters.Errors++
+		}
+	}
+}
+
+func counterFor(m map[string]*TrafficCounters, key string) *TrafficCounters {
+	counters, ok := m[key]
+	if !ok {
+		counters = &TrafficCounters{}
+		m[key] = counters
+	}
+	return counters
+}
+
+// hostCounters returns the counters of host, first folding the host with
+// the least traffic into otherHosts when the map is full. The caller holds s.mu.
+func (s *TrafficStats) hostCounters(host string) *TrafficCounters {
+	if _, ok := s.hosts[host]; ok || len(s.hosts) < maxTrackedHosts {
+		return counterFor(s.hosts, host)
+	}
+	other := counterFor(s.hosts, otherHosts)
+	for len(s.hosts) >= maxTrackedHosts {
+		var smallest string
+		var least int64 = -1
+		for name, counters := range s.hosts {
+			if bytes := counters.BytesUp + counters.BytesDown; name != otherHosts && (least < 0 || bytes < least) {
+				smallest, least = name, bytes
+			}
+		}
+		evicted := s.hosts[smallest]
+		other.Requests += evicted.Requests
+		other.Errors += evicted.Errors
+		other.Denied += evicted.Denied
+		other.Limited += evicted.Limited
+		other.BytesUp += evicted.BytesUp
+		other.BytesDown += evicted.BytesDown
+		other.DurationMs += evicted.DurationMs
+		delete(s.hosts, smallest)
+	}
+	return counterFor(s.hosts, host)
+}
+
+// Snapshot returns the live counters and the busiest hosts
+func (s *TrafficStats) Snapshot() *TrafficSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := s.totals
+	hosts := make(map[string]TrafficCounters, len(s.hosts))
+	for host, counters := range s.hosts {
+		hosts[host] = *counters
+	}
+	records := make(map[string]TrafficCounters, len(s.records))
+	for record, counters := range s.records {
+		records[record] = *counters
+	}
+
+	for ex := range s.active {
+		up, down := ex.up.Load(), ex.down.Load()
+		totals.BytesUp += up
+		totals.BytesDown += down
+		host, record := hosts[ex.host], records[ex.record]
+		host.BytesUp += up
+		host.BytesDown += down
+		record.BytesUp += up
+		record.BytesDown += down
+		hosts[ex.host], records[ex.record] = host, record
+	}
+
+	snapshot := &TrafficSnapshot{
+		Since:   s.since.Format(time.RFC3339),
+		Active:  len(s.active),
+		Totals:  totals,
+		Hosts:   sortedEntries(hosts),
+		Records: sortedEntries(records),
+	}
+	if len(snapshot.Hosts) > topHostsLimit {
+		snapshot.Hosts = snapshot.Hosts[:topHostsLimit]
+	}
+	return snapshot
+}
+
+// sortedEntries orders counters by total bytes, busiest first
+func sortedEntries(m map[string]TrafficCounters) []TrafficEntry {
+	entries := make([]TrafficEntry, 0, len(m))
+	for name, counters := range m {
+		entries = append(entries, TrafficEntry{Name: name, TrafficCounters: counters})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		bi := entries[i].BytesUp + entries[i].BytesDown
+		bj := entries[j].BytesUp + entries[j].BytesDown
+		if bi != bj {
+			return bi > bj
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// countingConn counts the bytes read from (up) and written to (down) the
+// client side of a tunnel
+type countingConn struct {
+	io.ReadWriteCloser
+	ex *trafficExchange
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	c.ex.up.Add(int64(n))
+	c.ex.throttle(n)
+	c.ex.schedule(true, n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.ex.throttle(len(b))
+	c.ex.schedule(false, len(b))
+	n, err := c.ReadWriteCloser.Write(b)
+	c.ex.down.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	closeWrite(c.ReadWriteCloser)
+	return nil
+}
+
+// countingBody counts the bytes read from a request (up) or response body
+type countingBody struct {
+	io.ReadCloser
+	ex *trafficExchange
+	up bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.up {
+		b.ex.up.Add(int64(n))
+	} else {
+		b.ex.down.Add(int64(n))
+	}
+	b.ex.throttle(n)
+	b.ex.schedule(b.up, n)
+	return n, err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHostCountersAreCapped(t *testing.T) {
+	s := NewTrafficStats()
+	busy := s.begin("busy.example:443", "")
+	busy.down.Add(1 << 20)
+	s.finish(busy)
+
+	for i := 0; i < 2*maxTrackedHosts; i++ {
+		ex := s.begin(fmt.Sprintf("host%d.example:443", i), "")
+		ex.down.Add(100)
+		s.finish(ex)
+	}
+
+	if len(s.hosts) > maxTrackedHosts {
+		t.Fatalf("tracking %d hosts, want at most %d", len(s.hosts), maxTrackedHosts)
+	}
+	snapshot := s.Snapshot()
+	if snapshot.Totals.Requests != 2*maxTrackedHosts+1 {
+		t.Fatalf("totals lost requests: %d", snapshot.Totals.Requests)
+	}
+	if snapshot.Hosts[0].Name != "busy.example" {
+		t.Errorf("busiest host evicted, top entry is %q", snapshot.Hosts[0].Name)
+	}
+	var requests, bytes int64
+	for _, counters := range s.hosts {
+		requests += counters.Requests
+		bytes += counters.BytesDown
+	}
+	if requests != snapshot.Totals.Requests || bytes != snapshot.Totals.BytesDown {
+		t.Errorf("host counters sum to %d requests / %d bytes, totals are %d / %d",
+			requests, bytes, snapshot.Totals.Requests, snapshot.Totals.BytesDown)
+	}
+	if s.hosts[otherHosts] == nil || s.hosts[otherHosts].Requests == 0 {
+		t.Error("evicted hosts were not folded into the other bucket")
+	}
+}
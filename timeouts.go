@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errResponseHeaderTimeout is returned when the origin does not start its
+// response in time
+var errResponseHeaderTimeout = errors.New("timed out waiting for response headers")
+
+// errLifetimeExceeded is returned when a request reaches its maximum lifetime
+var errLifetimeExceeded = errors.New("maximum connection lifetime reached")
+
+// errStreamIdle is returned when a response stops sending data
+var errStreamIdle = errors.New("response stalled: no data within the idle timeout")
+
+// timeoutSettings are the timeouts applied to one destination. Zero
+// disables a timeout.
+type timeoutSettings struct {
+	dial     time.Duration // TCP connect
+	tls      time.Duration // TLS handshake with the origin
+	header   time.Duration // request sent until response headers arrive
+	idle     time.Duration // plain-HTTP response sends no bytes
+	tunnel   time.Duration // no bytes either way on a CONNECT, SOCKS5 or upgraded tunnel
+	lifetime time.Duration // whole connection or request
+}
+
+// defaultTimeouts never cut an active stream: SSE responses from the Claude
+// API stay open as long as events (including pings) keep flowing. Tunnels
+// have no idle timeout unless one is configured, since an ssh session or a
+// websocket may rightly stay quiet for hours.
+var defaultTimeouts = timeoutSettings{
+	dial:   30 * time.Second,
+	tls:    10 * time.Second,
+	header: 5 * time.Minute,
+	idle:   5 * time.Minute,
+}
+
+// timeoutRule overrides some timeouts for hosts matching a glob
+type timeoutRule struct {
+	glob      string
+	overrides map[string]time.Duration
+}
+
+// timeoutPolicy resolves the timeouts for a destination host: the first
+// matching rule is applied over the record's settings
+type timeoutPolicy struct {
+	base  timeoutSettings
+	rules []timeoutRule
+}
+
+// newTimeoutPolicy builds the policy from the record's settings; zero fields
+// keep the defaults
+func newTimeoutPolicy(settings ProxySettings) (*timeoutPolicy, error) {
+	policy := &timeoutPolicy{base: defaultTimeouts}
+	for _, field := range []struct {
+		value int
+		dst   *time.Duration
+	}{
+		{settings.DialTimeout, &policy.base.dial},
+		{settings.TLSHandshakeTimeout, &policy.base.tls},
+		{settings.ResponseHeaderTimeout, &policy.base.header},
+		{settings.StreamIdleTimeout, &policy.base.idle},
+		{settings.TunnelIdleTimeout, &policy.base.tunnel},
+		{settings.MaxConnLifetime, &policy.base.lifetime},
+	} {
+		if field.value > 0 {
+			*field.dst = time.Duration(field.value) * time.Second
+		}
+	}
+
+	for _, line := range settings.TimeoutRules {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := timeoutRule{glob: strings.ToLower(fields[0]), overrides: make(map[string]time.Duration)}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			seconds, err := strconv.Atoi(value)
+			if !ok || err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid timeout rule %q: expected key=seconds, got %q", line, field)
+			}
+			switch key {
+			case "dial", "tls", "header", "idle", "tunnel", "lifetime":
+				rule.overrides[key] = time.Duration(seconds) * time.Second
+			default:
+				return nil, fmt.Errorf("invalid timeout rule %q: unknown timeout %q", line, key)
+			}
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+// forHost returns the timeouts for a destination host name or address
+func (t *timeoutPolicy) forHost(host string) timeoutSettings {
+	settings := t.base
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range t.rules {
+		if !shExpMatch(host, rule.glob) {
+			continue
+		}
+		for key, value := range rule.overrides {
+			switch key {
+			case "dial":
+				settings.dial = value
+			case "tls":
+				settings.tls = value
+			case "header":
+				settings.header = value
+			case "idle":
+				settings.idle = value
+			case "tunnel":
+				settings.tunnel = value
+			case "lifetime":
+				settings.lifetime = value
+			}
+		}
+		break
+	}
+	return settings
+}
+
+// forTarget is forHost for a host:port address
+func (t *timeoutPolicy) forTarget(target string) timeoutSettings {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return t.forHost(host)
+}
+
+// idleTimer calls onIdle once no activity has been recorded for idle. It
+// only re-arms itself when it fires, so touch stays cheap on hot paths.
+type idleTimer struct {
+	idle   time.Duration
+	last   atomic.Int64 // unix nanoseconds of the last activity
+	timer  *time.Timer
+	onIdle func()
+}
+
+// newIdleTimer returns nil when idle is zero; a nil timer ignores touch and stop
+func newIdleTimer(idle time.Duration, onIdle func()) *idleTimer {
+	if idle <= 0 {
+		return nil
+	}
+	t := &idleTimer{idle: idle, onIdle: onIdle}
+	t.touch()
+	t.timer = time.AfterFunc(idle, t.fire)
+	return t
+}
+
+func (t *idleTimer) fire() {
+	elapsed := time.Since(time.Unix(0, t.last.Load()))
+	if elapsed >= t.idle {
+		t.onIdle()
+		return
+	}
+	t.timer.Reset(t.idle - elapsed)
+}
+
+func (t *idleTimer) touch() {
+	if t != nil {
+		t.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// activityConn records reads and writes on an idle timer
+type activityConn struct {
+	io.ReadWriteCloser
+	timer *idleTimer
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		c.timer.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	if n > 0 {
+		c.timer.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) CloseWrite() error {
+	closeWrite(c.ReadWriteCloser)
+	return nil
+}
+
+// activityBody records reads of a response body on an idle timer
+type activityBody struct {
+	io.ReadCloser
+	timer *idleTimer
+}
+
+func (b *activityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.touch()
+	}
+	return n, err
+}
+
+func (b *activityBody) Close() error {
+	b.timer.stop()
+	return b.ReadCloser.Close()
+}
+
+// lifetimeTimer closes the given connections once lifetime has passed.
+// The returned stop function must be called when they are done.
+func lifetimeTimer(lifetime time.Duration, conns ...io.Closer) (stop func()) {
+	if lifetime <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(lifetime, func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return func() { timer.Stop() }
+}
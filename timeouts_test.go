@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTunnelIdleTimeoutIsOptIn(t *testing.T) {
+	policy, err := newTimeoutPolicy(ProxySettings{StreamIdleTimeout: 60, TimeoutRules: []string{"*.corp tunnel=600"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := policy.forHost("api.anthropic.com"); got.tunnel != 0 || got.idle != time.Minute {
+		t.Errorf("default host: tunnel idle %s, stream idle %s; want unlimited and 1m", got.tunnel, got.idle)
+	}
+	if got := policy.forHost("git.corp"); got.tunnel != 10*time.Minute {
+		t.Errorf("rule tunnel=600: got %s", got.tunnel)
+	}
+	if _, err := newTimeoutPolicy(ProxySettings{TimeoutRules: []string{"* tunnel=x"}}); err == nil {
+		t.Error("invalid tunnel value accepted")
+	}
+}
+
+func TestTunnelIdleTimeoutClosesQuietTunnel(t *testing.T) {
+	origin := newOrigin(t)
+	config := loopbackConfig()
+	config.TunnelIdleTimeout = 1
+	p := startTestProxy(t, config)
+
+	conn, err := net.Dial("tcp", p.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target := origin.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", err, resp)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("tunnel was not closed by the idle timeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("tunnel closed after %s, before the idle timeout", elapsed)
+	}
+}
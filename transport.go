@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Connection pool defaults for plain-HTTP egress
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newTransport returns an http.Transport with the record's pool settings.
+// Callers set DialContext / Proxy for the egress path it serves.
+func (p *ProxyServer) newTransport() *http.Transport {
+	transport := &http.Transport{
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSHandshakeTimeout:   p.timeouts.base.tls,
+		ExpectContinueTimeout: 1 * time.Second,
+		// A custom DialContext disables HTTP/2 unless forced
+		ForceAttemptHTTP2: true,
+	}
+	if p.settings.MaxIdleConns > 0 {
+		transport.MaxIdleConns = p.settings.MaxIdleConns
+	}
+	if p.settings.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = p.settings.MaxIdleConnsPerHost
+	}
+	if p.settings.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(p.settings.IdleConnTimeout) * time.Second
+	}
+	return transport
+}
+
+// newDirectTransport builds the shared transport for requests sent without
+// an upstream proxy
+func (p *ProxyServer) newDirectTransport() *http.Transport {
+	transport := p.newTransport()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dialDirect(ctx, addr)
+	}
+	// Dial TLS ourselves so the handshake timeout can differ per host
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := p.dialDirect(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: host,
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		if timeout := p.timeouts.forHost(host).tls; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return transport
+}
+
+// transportFor returns the long-lived transport for an upstream proxy URL
+// (empty for direct), creating it on first use
+func (p *ProxyServer) transportFor(upstream string) (http.RoundTripper, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if upstream == "" {
+		return p.directHTTP, nil
+	}
+	if transport, ok := p.transports[upstream]; ok {
+		return transport, nil
+	}
+	transport, _, err := p.newUpstreamTransport(upstream)
+	if err != nil {
+		return nil, err
+	}
+	p.transports[upstream] = transport
+	return transport, nil
+}
+
+// closeTransports drops idle connections of all transports; called on Stop
+func (p *ProxyServer) closeTransports() {
+	if p.directHTTP != nil {
+		p.directHTTP.CloseIdleConnections()
+	}
+	for key, transport := range p.transports {
+		closeIdleConnections(transport)
+		delete(p.transports, key)
+	}
+}
+
+func closeIdleConnections(transport http.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
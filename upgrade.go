@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the protocol a request asks to switch to (e.g.
+// "websocket"), or "" when it is not an upgrade request
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// hijack takes over the client connection. Bytes the server already read
+// past the request head (a client may pipeline its first tunnel bytes) are
+// returned before anything else is read from the connection.
+func hijack(w http.ResponseWriter) (net.Conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("hijacking not supported")
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack failed: %w", err)
+	}
+	if bufrw.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: bufrw.Reader}, nil
+	}
+	return conn, nil
+}
+
+// handleUpgradeResponse forwards a 101 Switching Protocols response and then
+// pipes bytes between the client and the origin connection in both directions
+func (p *ProxyServer) handleUpgradeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, upgrade string, timeouts timeoutSettings, ex *trafficExchange) {
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(resp.Header.Get("Upgrade"), upgrade) {
+		resp.Body.Close()
+		http.Error(w, "Invalid protocol switch from origin", http.StatusBadGateway)
+		p.log(LevelError, fmt.Sprintf("Origin %s switched to %q, expected %q", r.URL.Host, resp.Header.Get("Upgrade"), upgrade))
+		return
+	}
+	defer backConn.Close()
+
+	clientConn, err := hijack(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	ex.setCloser(connOpen, func() {
+		clientConn.Close()
+		backConn.Close()
+	})
+
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", resp.Header.Get("Upgrade"))
+	if p.settings.AddViaHeader {
+		header.Add("Via", p.viaValue(resp.ProtoMajor, resp.ProtoMinor))
+	}
+
+	bw := bufio.NewWriter(clientConn)
+	fmt.Fprintf(bw, "HTTP/1.1 %s\r\n", resp.Status)
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		p.log(LevelError, fmt.Sprintf("Failed to send upgrade response: %v", err))
+		return
+	}
+
+	p.log(LevelDebug, fmt.Sprintf("Upgraded %s to %s", r.URL.Host, upgrade))
+	ex.result = trafficOK
+	p.relay(&countingConn{ReadWriteCloser: clientConn, ex: ex}, backConn, timeouts)
+	p.log(LevelDebug, fmt.Sprintf("Upgrade %s completed", r.URL.Host))
+}
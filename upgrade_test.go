@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoOrigin starts an origin that switches to protocol on request and
+// then echoes every byte back; it answers with switchTo as its Upgrade
+func newEchoOrigin(t *testing.T, switchTo string) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) == "" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+switchTo+"\r\n\r\n")
+		io.Copy(conn, bufrw)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// sendUpgrade writes an upgrade request for origin through p, followed
+// immediately by first, and returns the connection and the response
+func sendUpgrade(t *testing.T, p *ProxyServer, origin *httptest.Server, first string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.proxyURL().Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+origin.URL+"/socket HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+
+		"\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\n"+first)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestUpgradePassthrough(t *testing.T) {
+	origin := newEchoOrigin(t, "echo")
+	p := startTestProxy(t, loopbackConfig())
+
+	// The first tunnel bytes are pipelined behind the request head
+	conn, br, resp := sendUpgrade(t, p, origin, "ping\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" ||
+		!strings.EqualFold(resp.Header.Get("Connection"), "Upgrade") {
+		t.Fatalf("got %s with Connection %q, Upgrade %q", resp.Status, resp.Header.Get("Connection"), resp.Header.Get("Upgrade"))
+	}
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("pipelined bytes: got %q, %v", line, err)
+	}
+	io.WriteString(conn, "pong\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "pong\n" {
+		t.Fatalf("echo: got %q, %v", line, err)
+	}
+}
+
+func TestUpgradeRejectsMismatchedProtocol(t *testing.T) {
+	origin := newEchoOrigin(t, "h2c")
+	p := startTestProxy(t, loopbackConfig())
+
+	_, _, resp := sendUpgrade(t, p, origin, "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("origin switched to another protocol: got %s, want 502", resp.Status)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamHandshakeTimeout bounds the CONNECT/SOCKS handshake with an upstream proxy
+const upstreamHandshakeTimeout = 30 * time.Second
+
+// Causes of a failed upstream handshake, matched with errors.Is
+var (
+	errUpstreamAuthRequired = errors.New("upstream proxy requires authentication")
+	errUpstreamForbidden    = errors.New("upstream proxy refused the target")
+	errUpstreamTimeout      = errors.New("upstream proxy handshake timed out")
+)
+
+// upstreamError reports a failed handshake with an upstream proxy
+type upstreamError struct {
+	proxy  string
+	target string
+	err    error
+}
+
+func newUpstreamError(upstream *upstreamProxy, target string, err error) error {
+	return &upstreamError{proxy: upstream.String(), target: target, err: err}
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream proxy %s, target %s: %v", e.proxy, e.target, e.err)
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// Is classifies timeouts that surface as plain network errors
+func (e *upstreamError) Is(target error) bool {
+	var netErr net.Error
+	return target == errUpstreamTimeout && errors.As(e.err, &netErr) && netErr.Timeout()
+}
+
+// upstreamStatusError is a non-2xx answer to CONNECT from an HTTP proxy
+type upstreamStatusError struct {
+	status int
+	reason string // status line text, e.g. "407 Proxy Authentication Required"
+	detail string
+}
+
+func (e *upstreamStatusError) Error() string {
+	msg := "proxy answered " + e.reason
+	if e.detail != "" {
+		msg += " (" + e.detail + ")"
+	}
+	return msg
+}
+
+func (e *upstreamStatusError) Unwrap() error {
+	switch e.status {
+	case http.StatusProxyAuthRequired:
+		return errUpstreamAuthRequired
+	case http.StatusForbidden:
+		return errUpstreamForbidden
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return errUpstreamTimeout
+	}
+	return nil
+}
+
+// upstreamProxy is a parsed upstream proxy URL (RemoteRecord.HTTPProxy/HTTPSProxy)
+type upstreamProxy struct {
+	url      *url.URL
+	scheme   string // http, https, socks5, socks5h or socks4a
+	addr     string // host:port of the proxy
+	user     string
+	password string
+	// basicAuth sends Basic credentials before the proxy asks ("?auth=basic")
+	basicAuth bool
+}
+
+// parseUpstreamProxy parses an upstream proxy URL. A bare host:port is
+// treated as an HTTP proxy.
+func parseUpstreamProxy(raw string) (*upstreamProxy, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	parsedURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if parsedURL.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+	}
+
+	scheme := strings.ToLower(parsedURL.Scheme)
+	var defaultPort string
+	switch scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	case "socks5", "socks5h", "socks4a":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", parsedURL.Scheme)
+	}
+
+	upstream := &upstreamProxy{
+		url:    parsedURL,
+		scheme: scheme,
+		addr:   parsedURL.Host,
+	}
+	if parsedURL.Port() == "" {
+		upstream.addr = net.JoinHostPort(parsedURL.Hostname(), defaultPort)
+	}
+	if parsedURL.User != nil {
+		upstream.user = parsedURL.User.Username()
+		upstream.password, _ = parsedURL.User.Password()
+	}
+	switch auth := parsedURL.Query().Get("auth"); strings.ToLower(auth) {
+	case "":
+	case authBasic:
+		upstream.basicAuth = true
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: unsupported auth %q, only basic can be sent preemptively", upstream, auth)
+	}
+	return upstream, nil
+}
+
+// isSOCKS reports whether the upstream speaks SOCKS rather than HTTP
+func (u *upstreamProxy) isSOCKS() bool {
+	return strings.HasPrefix(u.scheme, "socks")
+}
+
+// String returns the proxy URL without credentials, for logging
+func (u *upstreamProxy) String() string {
+	return u.scheme + "://" + u.addr
+}
+
+// newUpstreamTransport builds the transport for plain-HTTP requests sent
+// through an upstream proxy
+func (p *ProxyServer) newUpstreamTransport(proxyURL string) (http.RoundTripper, *upstreamProxy, error) {
+	upstream, err := parseUpstreamProxy(proxyURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tunnel := p.newTransport()
+	tunnel.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dialThroughProxy(ctx, proxyURL, addr)
+	}
+	if upstream.isSOCKS() {
+		// net/http has no SOCKS4a support, so dial SOCKS upstreams ourselves
+		return tunnel, upstream, nil
+	}
+
+	// net/http only sees a plain HTTP proxy: dialUpstream adds TLS for
+	// https:// proxies with our own CA and client certificate, and
+	// credentials are answered by proxyAuthTransport since net/http only
+	// knows Basic
+	plain := *upstream.url
+	plain.Scheme = "http"
+	plain.User = nil
+	base := p.newTransport()
+	base.Proxy = http.ProxyURL(&plain)
+	base.ProxyConnectHeader = make(http.Header)
+	p.addLoopMarker(base.ProxyConnectHeader)
+	if p.settings.AddViaHeader {
+		base.ProxyConnectHeader.Set("Via", p.viaValue(1, 1))
+	}
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := p.dialUpstream(ctx, upstream, time.Now().Add(upstreamHandshakeTimeout))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+	if upstream.user == "" {
+		return base, upstream, nil
+	}
+	return &proxyAuthTransport{
+		upstream: upstream,
+		state:    p.authState(upstream),
+		base:     base,
+		tunnel:   tunnel,
+	}, upstream, nil
+}
+
+// loadUpstreamTLS builds the TLS settings for https:// upstream proxies:
+// the system roots plus an optional CA bundle, and an optional client certificate
+func loadUpstreamTLS(settings ProxySettings) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+	}
+
+	if settings.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(settings.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", settings.UpstreamCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if settings.UpstreamCertFile != "" || settings.UpstreamKeyFile != "" {
+		if settings.UpstreamCertFile == "" || settings.UpstreamKeyFile == "" {
+			return nil, fmt.Errorf("upstream client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(settings.UpstreamCertFile, settings.UpstreamKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// upstreamTLSConfig returns the TLS config for connecting to an https:// proxy
+func (p *ProxyServer) upstreamTLSConfig(upstream *upstreamProxy) *tls.Config {
+	config := p.upstreamTLS.Clone()
+	config.ServerName = p.settings.UpstreamServerName
+	if config.ServerName == "" {
+		config.ServerName = upstream.url.Hostname()
+	}
+	return config
+}
+
+// socks5Connect performs the SOCKS5 client handshake on conn. With the
+// socks5 scheme the target is resolved locally and every address must pass
+// the guard; socks5h leaves DNS to the proxy.
+func (p *ProxyServer) socks5Connect(ctx context.Context, conn net.Conn, upstream *upstreamProxy, targetHost string) error {
+	host, port, err := splitTarget(targetHost)
+	if err != nil {
+		return err
+	}
+	if upstream.scheme == "socks5" && net.ParseIP(host) == nil {
+		addrs, err := p.resolver.lookup(ctx, host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", host, err)
+		}
+		if err := p.guard.checkAddrs(targetHost, addrs); err != nil {
+			return err
+		}
+		host = addrs[0].String()
+	}
+
+	// Method negotiation
+	methods := []byte{socksMethodNone}
+	if upstream.user != "" {
+		methods = append(methods, socksMethodUserPass)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 greeting: %w", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting reply: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("proxy is not a SOCKS5 server (version %d)", reply[0])
+	}
+
+	switch reply[1] {
+	case socksMethodNone:
+	case socksMethodUserPass:
+		if len(upstream.user) > 255 || len(upstream.password) > 255 {
+			return fmt.Errorf("SOCKS5 credentials too long")
+		}
+		auth := []byte{socksAuthVersion, byte(len(upstream.user))}
+		auth = append(auth, upstream.user...)
+		auth = append(auth, byte(len(upstream.password)))
+		auth = append(auth, upstream.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("failed to send SOCKS5 credentials: %w", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 auth reply: %w", err)
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("%w: SOCKS5 proxy rejected credentials for user %q", errUpstreamAuthRequired, upstream.user)
+		}
+	case socksMethodNoAcceptable:
+		return fmt.Errorf("%w: SOCKS5 proxy accepts none of our auth methods", errUpstreamAuthRequired)
+	default:
+		return fmt.Errorf("SOCKS5 proxy chose unsupported auth method %d", reply[1])
+	}
+
+	// CONNECT request
+	req := []byte{socks5Version, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksAtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksAtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 request: %w", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+	switch header[1] {
+	case socksReplySucceeded:
+	case socksReplyNotAllowed:
+		return fmt.Errorf("%w: %s", errUpstreamForbidden, socks5ReplyText(header[1]))
+	case socksReplyTTLExpired:
+		return fmt.Errorf("%w: %s", errUpstreamTimeout, socks5ReplyText(header[1]))
+	default:
+		return fmt.Errorf("SOCKS5 proxy rejected connection: %s", socks5ReplyText(header[1]))
+	}
+
+	// Skip the bound address
+	var skip int
+	switch header[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len
+	case socksAtypIPv6:
+		skip = net.IPv6len
+	case socksAtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+		}
+		skip = int(size[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply has unknown address type %d", header[3])
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(skip+2)); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+	return nil
+}
+
+// socks4aConnect performs the SOCKS4a client handshake on conn. Host
+// names are always resolved by the proxy.
+func socks4aConnect(conn net.Conn, upstream *upstreamProxy, targetHost string) error {
+	host, port, err := splitTarget(targetHost)
+	if err != nil {
+		return err
+	}
+
+	req := []byte{0x04, socksCmdConnect}
+	req = binary.BigEndian.AppendUint16(req, port)
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		req = append(req, ip.To4()...)
+		req = append(req, upstream.user...)
+		req = append(req, 0x00)
+	case ip != nil:
+		return fmt.Errorf("SOCKS4a does not support IPv6 target %s", host)
+	default:
+		// 0.0.0.x tells the proxy that a host name follows the user ID
+		req = append(req, 0x00, 0x00, 0x00, 0x01)
+		req = append(req, upstream.user...)
+		req = append(req, 0x00)
+		req = append(req, host...)
+		req = append(req, 0x00)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to send SOCKS4a request: %w", err)
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS4a reply: %w", err)
+	}
+	switch reply[1] {
+	case 0x5a:
+		return nil
+	case 0x5c, 0x5d:
+		return fmt.Errorf("%w: SOCKS4a identd check failed", errUpstreamAuthRequired)
+	default:
+		return fmt.Errorf("SOCKS4a proxy rejected connection (code %d)", reply[1])
+	}
+}
+
+// splitTarget splits a host:port target into host and numeric port
+func splitTarget(targetHost string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(targetHost)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %q: %w", targetHost, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in target %q", targetHost)
+	}
+	return host, uint16(port), nil
+}
+
+// socks5ReplyText describes a SOCKS5 reply code
+func socks5ReplyText(code byte) string {
+	switch code {
+	case socksReplyGeneralFailure:
+		return "general failure"
+	case socksReplyNotAllowed:
+		return "connection not allowed by ruleset"
+	case socksReplyNetworkUnreachable:
+		return "network unreachable"
+	case socksReplyHostUnreachable:
+		return "host unreachable"
+	case socksReplyConnectionRefused:
+		return "connection refused"
+	case socksReplyTTLExpired:
+		return "TTL expired"
+	case socksReplyCommandNotSupported:
+		return "command not supported"
+	case socksReplyAddressNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown error %d", code)
+	}
+}
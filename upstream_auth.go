@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Auth schemes understood for upstream HTTP proxies
+const (
+	authBasic     = "basic"
+	authDigest    = "digest"
+	authNTLM      = "ntlm"
+	authNegotiate = "negotiate" // answered with NTLM tokens, no Kerberos
+)
+
+// upstreamAuthState remembers which scheme an upstream proxy asked for,
+// so later handshakes can answer it up front instead of waiting for a 407
+type upstreamAuthState struct {
+	mu     sync.Mutex
+	scheme string
+	digest *digestChallenge
+}
+
+// authState returns the shared auth state for an upstream proxy
+func (p *ProxyServer) authState(upstream *upstreamProxy) *upstreamAuthState {
+	state, _ := p.authStates.LoadOrStore(upstream.user+"@"+upstream.addr, &upstreamAuthState{})
+	return state.(*upstreamAuthState)
+}
+
+func (s *upstreamAuthState) get() (string, *digestChallenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scheme, s.digest
+}
+
+func (s *upstreamAuthState) set(scheme string, digest *digestChallenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheme = scheme
+	s.digest = digest
+}
+
+// proxyChallenge is one Proxy-Authenticate challenge
+type proxyChallenge struct {
+	scheme string // lower case
+	token  string // NTLM token, or the raw auth-params
+	params map[string]string
+}
+
+// parseProxyChallenges parses the Proxy-Authenticate headers of a 407 response
+func parseProxyChallenges(header http.Header) []proxyChallenge {
+	var challenges []proxyChallenge
+	for _, value := range header.Values("Proxy-Authenticate") {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+		ch := proxyChallenge{
+			scheme: strings.ToLower(scheme),
+			token:  strings.TrimSpace(rest),
+		}
+		if ch.scheme == authDigest || ch.scheme == authBasic {
+			ch.params = parseAuthParams(ch.token)
+		}
+		challenges = append(challenges, ch)
+	}
+	return challenges
+}
+
+// preferredChallenge picks the strongest challenge we can answer
+func preferredChallenge(challenges []proxyChallenge) (proxyChallenge, bool) {
+	for _, want := range []string{authNTLM, authNegotiate, authDigest, authBasic} {
+		for _, ch := range challenges {
+			if ch.scheme == want {
+				return ch, true
+			}
+		}
+	}
+	return proxyChallenge{}, false
+}
+
+// parseAuthParams parses comma-separated key=value pairs with optional quoting
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
+
+// digestChallenge is a parsed Digest challenge (RFC 7616)
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	stale     bool
+
+	mu sync.Mutex
+	nc uint32
+}
+
+func newDigestChallenge(params map[string]string) (*digestChallenge, error) {
+	ch := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+		stale:     strings.EqualFold(params["stale"], "true"),
+	}
+	if ch.nonce == "" {
+		return nil, fmt.Errorf("digest challenge without nonce")
+	}
+	for _, qop := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			ch.qop = "auth"
+		}
+	}
+	if params["qop"] != "" && ch.qop == "" {
+		return nil, fmt.Errorf("unsupported digest qop %q", params["qop"])
+	}
+	return ch, nil
+}
+
+// authorize computes the Digest Proxy-Authorization value for one request
+func (ch *digestChallenge) authorize(user, password, method, uri string) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := strings.ToUpper(ch.algorithm)
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", ch.algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		io.WriteString(sum, s)
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ch.mu.Lock()
+	ch.nc++
+	nc := fmt.Sprintf("%08x", ch.nc)
+	ch.mu.Unlock()
+
+	cnonceBytes := make([]byte, 8)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	ha1 := h(user + ":" + ch.realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if ch.qop != "" {
+		response = h(strings.Join([]string{ha1, ch.nonce, nc, cnonce, ch.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + ch.nonce + ":" + ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, user),
+		fmt.Sprintf(`realm="%s"`, ch.realm),
+		fmt.Sprintf(`nonce="%s"`, ch.nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if ch.algorithm != "" {
+		fields = append(fields, "algorithm="+ch.algorithm)
+	}
+	if ch.opaque != "" {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, ch.opaque))
+	}
+	if ch.qop != "" {
+		fields = append(fields, "qop="+ch.qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+func basicAuthorization(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// connectionAuth reports whether a scheme authenticates the connection
+// rather than each request
+func connectionAuth(scheme string) bool {
+	return scheme == authNTLM || scheme == authNegotiate
+}
+
+// ntlmAuthorization formats an NTLM message under the scheme name the proxy
+// challenged with, as Negotiate-only proxies reject "NTLM"
+func ntlmAuthorization(scheme string, msg []byte) string {
+	name := "NTLM"
+	if scheme == authNegotiate {
+		name = "Negotiate"
+	}
+	return name + " " + base64.StdEncoding.EncodeToString(msg)
+}
+
+// proxyAuthHandshake produces the Proxy-Authorization header for each
+// attempt of one request, answering the previous 407 challenge
+type proxyAuthHandshake struct {
+	upstream *upstreamProxy
+	state    *upstreamAuthState
+	sent     string // scheme used in the last attempt
+	final    bool   // the last attempt answered an NTLM type 2 challenge
+}
+
+func newProxyAuthHandshake(upstream *upstreamProxy, state *upstreamAuthState) *proxyAuthHandshake {
+	return &proxyAuthHandshake{upstream: upstream, state: state}
+}
+
+// initial returns the header for the first attempt, based on what the
+// proxy asked for last time. Until a 407 names a scheme nothing is sent, so
+// the password never goes out as Basic to a Digest or NTLM proxy, unless
+// the proxy URL opts into preemptive Basic with "?auth=basic".
+func (a *proxyAuthHandshake) initial(method, uri string) (string, error) {
+	if a.upstream.user == "" {
+		return "", nil
+	}
+	scheme, digest := a.state.get()
+	switch {
+	case connectionAuth(scheme):
+		a.sent = scheme
+		return ntlmAuthorization(scheme, ntlmNegotiateMessage()), nil
+	case scheme == authDigest && digest != nil:
+		a.sent = authDigest
+		return digest.authorize(a.upstream.user, a.upstream.password, method, uri)
+	case scheme == authBasic || a.upstream.basicAuth:
+		a.sent = authBasic
+		return basicAuthorization(a.upstream.user, a.upstream.password), nil
+	default:
+		return "", nil
+	}
+}
+
+// respond returns the header for the next attempt after a 407 response
+func (a *proxyAuthHandshake) respond(resp *http.Response, method, uri string) (string, error) {
+	if a.upstream.user == "" {
+		return "", fmt.Errorf("proxy requires authentication but no credentials are configured")
+	}
+	challenges := parseProxyChallenges(resp.Header)
+
+	// Second leg of NTLM: answer the type 2 challenge on the same connection
+	if connectionAuth(a.sent) && !a.final {
+		for _, ch := range challenges {
+			if ch.scheme == a.sent && ch.token != "" {
+				raw, err := base64.StdEncoding.DecodeString(ch.token)
+				if err != nil {
+					return "", fmt.Errorf("invalid NTLM challenge: %w", err)
+				}
+				challenge, err := parseNTLMChallenge(raw)
+				if err != nil {
+					return "", err
+				}
+				msg, err := ntlmAuthenticateMessage(challenge, a.upstream.user, a.upstream.password)
+				if err != nil {
+					return "", err
+				}
+				a.final = true
+				return ntlmAuthorization(a.sent, msg), nil
+			}
+		}
+	}
+
+	ch, ok := preferredChallenge(challenges)
+	if !ok {
+		return "", fmt.Errorf("proxy offers no supported auth scheme")
+	}
+	switch ch.scheme {
+	case authNTLM, authNegotiate:
+		if a.final {
+			return "", fmt.Errorf("proxy rejected NTLM credentials for user %q", a.upstream.user)
+		}
+		a.state.set(ch.scheme, nil)
+		a.sent = ch.scheme
+		return ntlmAuthorization(ch.scheme, ntlmNegotiateMessage()), nil
+	case authDigest:
+		digest, err := newDigestChallenge(ch.params)
+		if err != nil {
+			return "", err
+		}
+		if a.sent == authDigest && !digest.stale {
+			return "", fmt.Errorf("proxy rejected Digest credentials for user %q", a.upstream.user)
+		}
+		a.state.set(authDigest, digest)
+		a.sent = authDigest
+		return digest.authorize(a.upstream.user, a.upstream.password, method, uri)
+	default:
+		if a.sent == authBasic {
+			return "", fmt.Errorf("proxy rejected Basic credentials for user %q", a.upstream.user)
+		}
+		a.state.set(authBasic, nil)
+		a.sent = authBasic
+		return basicAuthorization(a.upstream.user, a.upstream.password), nil
+	}
+}
+
+// proxyAuthTransport forwards plain-HTTP requests in absolute form through
+// an authenticating upstream HTTP proxy. Basic and Digest are answered
+// in place; NTLM and Negotiate authenticate a connection rather than a
+// request, so those requests are sent through a CONNECT tunnel instead.
+type proxyAuthTransport struct {
+	upstream *upstreamProxy
+	state    *upstreamAuthState
+	base     http.RoundTripper // absolute-form requests to the proxy
+	tunnel   http.RoundTripper // origin-form requests over a CONNECT tunnel
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scheme, _ := t.state.get()
+	if connectionAuth(scheme) {
+		return t.tunnel.RoundTrip(req)
+	}
+	// Without a known scheme the first attempt carries no credentials, and a
+	// streamed body could not be resent after the 407. The CONNECT handshake
+	// answers the challenge before any of the body is sent.
+	streamed := req.Body != nil && req.Body != http.NoBody && req.GetBody == nil
+	if scheme == "" && streamed && !t.upstream.basicAuth {
+		return t.tunnel.RoundTrip(req)
+	}
+
+	handshake := newProxyAuthHandshake(t.upstream, t.state)
+	uri := req.URL.Scheme + "://" + req.URL.Host + req.URL.RequestURI()
+	header, err := handshake.initial(req.Method, uri)
+	if err != nil {
+		return nil, err
+	}
+	// A Digest answer may be refused once more with stale=true
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(withProxyAuthorization(req, header))
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || attempt >= 2 {
+			return resp, err
+		}
+
+		// A streamed request body is gone after the first attempt
+		if streamed {
+			return resp, nil
+		}
+		header, err = handshake.respond(resp, req.Method, uri)
+		if err != nil {
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if req, err = rewindRequest(req); err != nil {
+			return nil, err
+		}
+		if connectionAuth(handshake.sent) {
+			return t.tunnel.RoundTrip(req)
+		}
+	}
+}
+
+// CloseIdleConnections closes idle connections of both underlying transports
+func (t *proxyAuthTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+	closeIdleConnections(t.tunnel)
+}
+
+// withProxyAuthorization returns a copy of req carrying the given header
+func withProxyAuthorization(req *http.Request, value string) *http.Request {
+	if value == "" {
+		return req
+	}
+	out := req.Clone(req.Context())
+	out.Header.Set("Proxy-Authorization", value)
+	return out
+}
+
+// rewindRequest returns a copy of req with a fresh body for a retry
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	return out, nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	testProxyUser     = `CORP\alice`
+	testProxyPassword = "s3cret"
+)
+
+// authProxy is a stand-in upstream HTTP proxy that requires one auth scheme.
+// It answers CONNECT by relaying to the target and forwards absolute-form
+// requests itself.
+type authProxy struct {
+	scheme string // basic, digest, ntlm or negotiate
+	stale  bool   // digest: reject the first nonce once with stale=true
+	addr   string
+
+	mu     sync.Mutex
+	nonce  string
+	staled bool
+	seen   []string // Proxy-Authorization of every request, in order
+}
+
+func newAuthProxy(t *testing.T, scheme string, stale bool) *authProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	a := &authProxy{scheme: scheme, stale: stale, addr: listener.Addr().String(), nonce: "nonce-1"}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go a.serve(conn)
+		}
+	}()
+	return a
+}
+
+// url returns the proxy URL with the test credentials and an optional query
+func (a *authProxy) url(query string) string {
+	return "http://CORP%5Calice:" + testProxyPassword + "@" + a.addr + query
+}
+
+func (a *authProxy) headers() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.seen...)
+}
+
+func (a *authProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	ntlmStage := 0 // NTLM state is per connection
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		auth := req.Header.Get("Proxy-Authorization")
+		a.mu.Lock()
+		a.seen = append(a.seen, auth)
+		a.mu.Unlock()
+
+		if challenge, ok := a.check(auth, req.Method, req.RequestURI, &ntlmStage); !ok {
+			fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s\r\nContent-Length: 0\r\n\r\n", challenge)
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			defer target.Close()
+			fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(target, br)
+			io.Copy(conn, target)
+			return
+		}
+		out := req.Clone(req.Context())
+		out.RequestURI = ""
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(out)
+		if err != nil {
+			fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		resp.Write(conn)
+		resp.Body.Close()
+	}
+}
+
+// check validates a Proxy-Authorization header, returning the challenge to
+// send when it is not accepted
+func (a *authProxy) check(auth, method, uri string, ntlmStage *int) (string, bool) {
+	scheme, value, _ := strings.Cut(auth, " ")
+	switch a.scheme {
+	case authBasic:
+		want := base64.StdEncoding.EncodeToString([]byte(testProxyUser + ":" + testProxyPassword))
+		return `Basic realm="test"`, scheme == "Basic" && value == want
+	case authDigest:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		challenge := fmt.Sprintf(`Digest realm="test", nonce=%q, qop="auth", algorithm=MD5`, a.nonce)
+		if scheme != "Digest" {
+			return challenge, false
+		}
+		params := parseAuthParams(value)
+		if params["nonce"] != a.nonce || params["uri"] != uri || params["response"] != digestResponse(params, method) {
+			return challenge, false
+		}
+		if a.stale && !a.staled {
+			a.staled = true
+			a.nonce = "nonce-2"
+			return fmt.Sprintf(`Digest realm="test", nonce=%q, qop="auth", algorithm=MD5, stale=true`, a.nonce), false
+		}
+		return "", true
+	default:
+		name := "NTLM"
+		if a.scheme == authNegotiate {
+			name = "Negotiate"
+		}
+		raw, err := base64.StdEncoding.DecodeString(value)
+		if scheme != name || err != nil || len(raw) < 12 {
+			*ntlmStage = 0
+			return name, false
+		}
+		switch binary.LittleEndian.Uint32(raw[8:]) {
+		case 1:
+			*ntlmStage = 1
+			return name + " " + base64.StdEncoding.EncodeToString(testNTLMChallenge), false
+		case 3:
+			ok := *ntlmStage == 1 && verifyNTLMAuthenticate(raw)
+			*ntlmStage = 0
+			return name, ok
+		}
+		return name, false
+	}
+}
+
+// digestResponse computes the expected qop=auth MD5 response
+func digestResponse(params map[string]string, method string) string {
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(testProxyUser + ":" + params["realm"] + ":" + testProxyPassword)
+	ha2 := h(method + ":" + params["uri"])
+	return h(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+}
+
+var testNTLMServerChallenge = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+// testNTLMChallenge is a type 2 message with an empty target info list
+var testNTLMChallenge = func() []byte {
+	targetInfo := []byte{0, 0, 0, 0} // MsvAvEOL
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[16:], 48) // empty target name
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo)
+	copy(msg[24:], testNTLMServerChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, targetInfo...)
+}()
+
+// verifyNTLMAuthenticate checks the NTLMv2 proof of a type 3 message
+func verifyNTLMAuthenticate(msg []byte) bool {
+	field := func(i int) []byte {
+		pos := 12 + i*8
+		size := int(binary.LittleEndian.Uint16(msg[pos:]))
+		offset := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+		if offset+size > len(msg) {
+			return nil
+		}
+		return msg[offset : offset+size]
+	}
+	if len(msg) < 64 {
+		return false
+	}
+	ntResponse, domain, user := field(1), field(2), field(3)
+	if len(ntResponse) < 16 || !bytes.Equal(domain, ntlmUnicodeString("CORP")) || !bytes.Equal(user, ntlmUnicodeString("alice")) {
+		return false
+	}
+	hash := md4.New()
+	hash.Write(ntlmUnicodeString(testProxyPassword))
+	key := hmac.New(md5.New, hash.Sum(nil))
+	key.Write(ntlmUnicodeString("ALICE" + "CORP"))
+	mac := hmac.New(md5.New, key.Sum(nil))
+	mac.Write(testNTLMServerChallenge)
+	mac.Write(ntResponse[16:])
+	return hmac.Equal(mac.Sum(nil), ntResponse[:16])
+}
+
+var authSchemeCases = []struct {
+	name   string
+	scheme string
+	stale  bool
+	header string // Proxy-Authorization prefix the proxy must see
+}{
+	{"basic", authBasic, false, "Basic "},
+	{"digest", authDigest, false, "Digest "},
+	{"digest stale nonce", authDigest, true, "Digest "},
+	{"ntlm", authNTLM, false, "NTLM "},
+	{"negotiate", authNegotiate, false, "Negotiate "},
+}
+
+// checkAuthHeaders verifies that no credentials went out before the first
+// challenge and that every later header uses the challenged scheme
+func checkAuthHeaders(t *testing.T, headers []string, prefix string) {
+	t.Helper()
+	if len(headers) == 0 || headers[0] != "" {
+		t.Fatalf("first request carried credentials before any challenge: %q", headers)
+	}
+	for _, header := range headers[1:] {
+		if header != "" && !strings.HasPrefix(header, prefix) {
+			t.Errorf("got Proxy-Authorization %q, want scheme %q", header, prefix)
+		}
+	}
+}
+
+func TestHTTPConnectAuth(t *testing.T) {
+	for _, tc := range authSchemeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := newOrigin(t)
+			upstream := newAuthProxy(t, tc.scheme, tc.stale)
+			p := startTestProxy(t, loopbackConfig())
+
+			// The second tunnel answers the remembered scheme up front
+			for i := 0; i < 2; i++ {
+				conn, err := p.dialThroughProxy(context.Background(), upstream.url(""), origin.Listener.Addr().String())
+				if err != nil {
+					t.Fatalf("tunnel %d: %v", i+1, err)
+				}
+				fmt.Fprintf(conn, "GET /tunnel HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n")
+				body, _ := io.ReadAll(conn)
+				conn.Close()
+				if !bytes.Contains(body, []byte("hello /tunnel")) {
+					t.Fatalf("tunnel %d: unexpected response %q", i+1, body)
+				}
+			}
+			headers := upstream.headers()
+			checkAuthHeaders(t, headers, tc.header)
+			if last := headers[len(headers)-1]; !strings.HasPrefix(last, tc.header) {
+				t.Errorf("second tunnel ended with %q", last)
+			}
+		})
+	}
+}
+
+func TestHTTPConnectPreemptiveBasic(t *testing.T) {
+	origin := newOrigin(t)
+	upstream := newAuthProxy(t, authBasic, false)
+	p := startTestProxy(t, loopbackConfig())
+
+	conn, err := p.dialThroughProxy(context.Background(), upstream.url("?auth=basic"), origin.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if headers := upstream.headers(); len(headers) != 1 || !strings.HasPrefix(headers[0], "Basic ") {
+		t.Fatalf("want a single preemptive Basic request, got %q", headers)
+	}
+}
+
+func TestProxyAuthTransport(t *testing.T) {
+	for _, tc := range authSchemeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := newOrigin(t)
+			upstream := newAuthProxy(t, tc.scheme, tc.stale)
+			config := loopbackConfig()
+			config.HTTPProxy = upstream.url("")
+			client := proxyClient(startTestProxy(t, config))
+
+			// A streamed POST first, then requests once the scheme is known
+			requests := []struct{ method, path string }{
+				{http.MethodPost, "/upload"},
+				{http.MethodGet, "/one"},
+				{http.MethodGet, "/two"},
+			}
+			for _, r := range requests {
+				req, _ := http.NewRequest(r.method, origin.URL+r.path, io.NopCloser(strings.NewReader("payload")))
+				if r.method == http.MethodGet {
+					req.Body = nil
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("%s %s: %v", r.method, r.path, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || string(body) != "hello "+r.path {
+					t.Fatalf("%s %s: got %d %q", r.method, r.path, resp.StatusCode, body)
+				}
+			}
+			checkAuthHeaders(t, upstream.headers(), tc.header)
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socksProxy is a stand-in SOCKS5 / SOCKS4a upstream. It records the
+// destination host each client asked for and connects every name to
+// 127.0.0.1.
+type socksProxy struct {
+	addr      string
+	user      string // SOCKS5 username/password required when set
+	password  string
+	requested chan string
+}
+
+func newSOCKSProxy(t *testing.T, user, password string) *socksProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &socksProxy{addr: listener.Addr().String(), user: user, password: password, requested: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	version, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	var host string
+	var port uint16
+	if version == 0x04 {
+		host, port, err = s.readSOCKS4a(br)
+	} else {
+		host, port, err = s.readSOCKS5(br, conn)
+	}
+	if err != nil {
+		return
+	}
+	s.requested <- host
+
+	target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	if version == 0x04 {
+		conn.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+	} else {
+		conn.Write([]byte{socks5Version, socksReplySucceeded, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+	go io.Copy(target, br)
+	io.Copy(conn, target)
+}
+
+func (s *socksProxy) readSOCKS5(br *bufio.Reader, conn net.Conn) (string, uint16, error) {
+	methods := make([]byte, 1)
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", 0, err
+	}
+	methods = make([]byte, methods[0])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", 0, err
+	}
+	if s.user == "" {
+		conn.Write([]byte{socks5Version, socksMethodNone})
+	} else {
+		conn.Write([]byte{socks5Version, socksMethodUserPass})
+		var auth [2]byte
+		if _, err := io.ReadFull(br, auth[:]); err != nil {
+			return "", 0, err
+		}
+		user := make([]byte, auth[1])
+		io.ReadFull(br, user)
+		n, _ := br.ReadByte()
+		password := make([]byte, n)
+		if _, err := io.ReadFull(br, password); err != nil {
+			return "", 0, err
+		}
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{socksAuthVersion, 0x01})
+			return "", 0, io.EOF
+		}
+		conn.Write([]byte{socksAuthVersion, 0x00})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch header[3] {
+	case socksAtypIPv4:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case socksAtypIPv6:
+		ip := make([]byte, 16)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		n, _ := br.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(br, name)
+		host = string(name)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(port[:]), nil
+}
+
+func (s *socksProxy) readSOCKS4a(br *bufio.Reader) (string, uint16, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", 0, err
+	}
+	if _, err := br.ReadString(0); err != nil { // user ID
+		return "", 0, err
+	}
+	host := net.IP(header[3:7]).String()
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		name, err := br.ReadString(0)
+		if err != nil {
+			return "", 0, err
+		}
+		host = name[:len(name)-1]
+	}
+	return host, binary.BigEndian.Uint16(header[1:3]), nil
+}
+
+func TestSOCKSUpstreams(t *testing.T) {
+	cases := []struct {
+		scheme   string
+		user     string
+		wantHost string // what the upstream is asked to connect to
+	}{
+		{"socks5", "", "127.0.0.1"}, // resolved locally
+		{"socks5", "alice", "127.0.0.1"},
+		{"socks5h", "", "origin.test"}, // resolved by the upstream
+		{"socks5h", "alice", "origin.test"},
+		{"socks4a", "", "origin.test"},
+	}
+	for _, tc := range cases {
+		name := tc.scheme
+		if tc.user != "" {
+			name += "-auth"
+		}
+		t.Run(name, func(t *testing.T) {
+			origin := newOrigin(t)
+			_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+			upstream := newSOCKSProxy(t, tc.user, "s3cret")
+			proxyURL := tc.scheme + "://" + upstream.addr
+			if tc.user != "" {
+				proxyURL = tc.scheme + "://" + tc.user + ":s3cret@" + upstream.addr
+			}
+
+			config := loopbackConfig()
+			config.HTTPProxy = proxyURL
+			config.HTTPSProxy = proxyURL
+			config.DNSHosts = []string{"127.0.0.1 origin.test"}
+			p := startTestProxy(t, config)
+
+			resp, err := proxyClient(p).Get("http://origin.test:" + port + "/plain")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "hello /plain" {
+				t.Fatalf("plain request: got %s %q", resp.Status, body)
+			}
+			if host := <-upstream.requested; host != tc.wantHost {
+				t.Errorf("plain request: upstream asked for %q, want %q", host, tc.wantHost)
+			}
+
+			conn, err := net.Dial("tcp", p.proxyURL().Host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, "CONNECT origin.test:"+port+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+			br := bufio.NewReader(conn)
+			connected, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if connected.StatusCode != http.StatusOK {
+				t.Fatalf("CONNECT: got %s", connected.Status)
+			}
+			io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: origin.test\r\nConnection: close\r\n\r\n")
+			body, _ = io.ReadAll(br)
+			if !strings.Contains(string(body), "hello /tunnel") {
+				t.Fatalf("tunnel: unexpected response %q", body)
+			}
+			if host := <-upstream.requested; host != tc.wantHost {
+				t.Errorf("tunnel: upstream asked for %q, want %q", host, tc.wantHost)
+			}
+		})
+	}
+}
+
+// scriptedProxy is a stand-in upstream HTTP proxy that answers every
+// CONNECT with response, written in one piece, and then holds the
+// connection open
+func scriptedProxy(t *testing.T, response string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, response)
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHTTPConnectRejectsErrorWithSuccessInBody(t *testing.T) {
+	body := "HTTP/1.1 200 Connection established"
+	upstream := scriptedProxy(t, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	p := startTestProxy(t, loopbackConfig())
+
+	conn, err := p.dialThroughProxy(context.Background(), "http://"+upstream, "198.51.100.1:443")
+	if err == nil {
+		conn.Close()
+		t.Fatal("a 407 whose body mentions 200 was taken as an established tunnel")
+	}
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.status != http.StatusProxyAuthRequired {
+		t.Fatalf("got %v, want the upstream's 407", err)
+	}
+}
+
+func TestHTTPConnectKeepsBytesBufferedBehindResponse(t *testing.T) {
+	// A server that talks first (SSH, SMTP) may arrive in the same segment
+	// as the CONNECT response
+	upstream := scriptedProxy(t, "HTTP/1.1 200 Connection established\r\nProxy-Agent: test\r\n\r\nSSH-2.0-test\r\n")
+	p := startTestProxy(t, loopbackConfig())
+
+	conn, err := p.dialThroughProxy(context.Background(), "http://"+upstream, "198.51.100.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || banner != "SSH-2.0-test\r\n" {
+		t.Fatalf("tunnel started with %q, %v; want the server banner", banner, err)
+	}
+}